@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const adminSocketAddress = "/run/docker-volume-freenas/admin.sock"
+
+// adminResponse wraps every admin API reply. Err is set when the request
+// failed, Data holds the result of a successful request.
+type adminResponse struct {
+	Err  string          `json:",omitempty"`
+	Data json.RawMessage `json:",omitempty"`
+}
+
+type adminResizeRequest struct {
+	Name string
+	Size int
+}
+
+type adminVolumeRequest struct {
+	Name string
+}
+
+type adminSnapshotRequest struct {
+	Name     string
+	Snapshot string
+}
+
+// adminHandler decodes the request body with decode and writes its result
+// or error as an adminResponse.
+func adminHandler(decode func(body []byte) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.WithField("method", "admin").Debug(r.URL.Path)
+
+		var res adminResponse
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err == nil {
+			var data interface{}
+			data, err = decode(body)
+			if err == nil && data != nil {
+				res.Data, err = json.Marshal(data)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			res.Err = err.Error()
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// serveAdmin serves the admin API on a unix socket only reachable by root.
+func (d *FreeNASISCSIDriver) serveAdmin(addr string) error {
+	if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
+		return err
+	}
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(addr, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resize", adminHandler(func(body []byte) (interface{}, error) {
+		var req adminResizeRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.Resize(req.Name, req.Size)
+	}))
+	mux.HandleFunc("/snapshot/create", adminHandler(func(body []byte) (interface{}, error) {
+		var req adminSnapshotRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		return d.CreateSnapshot(req.Name, req.Snapshot)
+	}))
+	mux.HandleFunc("/snapshot/list", adminHandler(func(body []byte) (interface{}, error) {
+		var req adminSnapshotRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		return d.ListSnapshots(req.Name)
+	}))
+	mux.HandleFunc("/snapshot/remove", adminHandler(func(body []byte) (interface{}, error) {
+		var req adminSnapshotRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.RemoveSnapshot(req.Name, req.Snapshot)
+	}))
+	mux.HandleFunc("/snapshot/rollback", adminHandler(func(body []byte) (interface{}, error) {
+		var req adminSnapshotRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.RollbackSnapshot(req.Name, req.Snapshot)
+	}))
+	mux.HandleFunc("/luks/rotate", adminHandler(func(body []byte) (interface{}, error) {
+		var req adminVolumeRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.RotateKey(req.Name)
+	}))
+	mux.HandleFunc("/zfs/lock", adminHandler(func(body []byte) (interface{}, error) {
+		var req adminVolumeRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.LockVolume(req.Name)
+	}))
+	mux.HandleFunc("/zfs/unlock", adminHandler(func(body []byte) (interface{}, error) {
+		var req adminVolumeRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		return nil, d.UnlockVolume(req.Name)
+	}))
+	mux.HandleFunc("/zfs/export-key", adminHandler(func(body []byte) (interface{}, error) {
+		var req adminVolumeRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		return d.ExportKey(req.Name)
+	}))
+	return http.Serve(l, mux)
+}
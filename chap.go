@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daneshih1125/docker-volume-freenas/freenas"
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+const (
+	chapNone   = "none"
+	chapOneWay = "chap"
+	chapMutual = "mutual"
+)
+
+// chapConfig holds the CHAP credentials of the plugin. The secrets are read
+// from files so they never show up in the environment of the plugin.
+type chapConfig struct {
+	Mode           string
+	User           string
+	SecretFile     string
+	PeerUser       string
+	PeerSecretFile string
+
+	secret     string
+	peerSecret string
+}
+
+// authType is the FreeNAS target group auth type for the CHAP mode.
+func (c *chapConfig) authType() string {
+	switch c.Mode {
+	case chapOneWay:
+		return "CHAP"
+	case chapMutual:
+		return "CHAP Mutual"
+	}
+	return ""
+}
+
+func readSecret(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("secret file not configured")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(data))
+	// FreeNAS only accepts CHAP secrets of 12 to 16 characters
+	if len(secret) < 12 || len(secret) > 16 {
+		return "", fmt.Errorf("secret in %s must be 12 to 16 characters long", path)
+	}
+	return secret, nil
+}
+
+// load validates the configuration and reads the secrets.
+func (c *chapConfig) load() (err error) {
+	switch c.Mode {
+	case "", chapNone:
+		c.Mode = chapNone
+		return nil
+	case chapOneWay, chapMutual:
+	default:
+		return fmt.Errorf("invalid CHAP mode %q, use none, chap or mutual", c.Mode)
+	}
+	if c.User == "" {
+		return errors.New("FREENAS_CHAP_USER must be set")
+	}
+	if c.secret, err = readSecret(c.SecretFile); err != nil {
+		return fmt.Errorf("FREENAS_CHAP_SECRET_FILE: %s", err)
+	}
+	if c.Mode == chapMutual {
+		if c.PeerUser == "" {
+			return errors.New("FREENAS_CHAP_PEER_USER must be set")
+		}
+		if c.peerSecret, err = readSecret(c.PeerSecretFile); err != nil {
+			return fmt.Errorf("FREENAS_CHAP_PEER_SECRET_FILE: %s", err)
+		}
+	}
+	return nil
+}
+
+// ensureAuthGroup finds or creates the FreeNAS auth group holding the
+// plugin's CHAP credentials and returns its tag.
+func (d *FreeNASISCSIDriver) ensureAuthGroup() (int, error) {
+	c := &d.opts.CHAP
+	creds, err := d.freenas.GetISCSIAuthCredentialList()
+	if err != nil {
+		return 0, err
+	}
+	want := freenas.ISCSIAuthCredential{
+		User:   c.User,
+		Secret: c.secret,
+	}
+	if c.Mode == chapMutual {
+		want.PeerUser, want.PeerSecret = c.PeerUser, c.peerSecret
+	}
+	maxTag := 0
+	for _, cred := range creds {
+		if cred.Tag > maxTag {
+			maxTag = cred.Tag
+		}
+		if cred.User != c.User {
+			continue
+		}
+		if cred.Secret != want.Secret || cred.PeerUser != want.PeerUser || cred.PeerSecret != want.PeerSecret {
+			want.ID, want.Tag = cred.ID, cred.Tag
+			if _, err := d.freenas.UpdateISCSIAuthCredential(want); err != nil {
+				return 0, err
+			}
+			log.WithField("authGroup", cred.Tag).Info("updated CHAP credentials")
+		}
+		return cred.Tag, nil
+	}
+	want.Tag = maxTag + 1
+	cred, err := d.freenas.CreateISCSIAuthCredential(want)
+	if err != nil {
+		return 0, err
+	}
+	log.WithField("authGroup", cred.Tag).Info("created CHAP credentials")
+	return cred.Tag, nil
+}
+
+// applyNodeAuth configures the node record of the target with the CHAP
+// credentials before login. Targets created without CHAP are left alone.
+func (d *FreeNASISCSIDriver) applyNodeAuth(v *FreeNASISCSIVolume, iqn string) error {
+	if v.AuthType == "" {
+		return nil
+	}
+	c := &d.opts.CHAP
+	if c.Mode == chapNone {
+		return fmt.Errorf("volume %s requires %s authentication but CHAP is not configured", v.Name, v.AuthType)
+	}
+	params := [][2]string{
+		{"node.session.auth.authmethod", "CHAP"},
+		{"node.session.auth.username", c.User},
+	}
+	secrets := map[string]string{"node.session.auth.password": c.secret}
+	if v.AuthType == "CHAP Mutual" {
+		params = append(params, [2]string{"node.session.auth.username_in", c.PeerUser})
+		secrets["node.session.auth.password_in"] = c.peerSecret
+	}
+	for _, p := range params {
+		if err := utils.UpdateISCSINode(iqn, p[0], p[1]); err != nil {
+			return err
+		}
+	}
+	// the secrets would show up in the process list as iscsiadm arguments
+	return utils.SetISCSINodeSecrets(iqn, secrets)
+}
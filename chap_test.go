@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{"secret", "averylongsecret", "averylongsecret", false},
+		{"trailing newline", "averylongsecret\n", "averylongsecret", false},
+		{"12 characters", "twelvechars!", "twelvechars!", false},
+		{"16 characters", "sixteencharacter", "sixteencharacter", false},
+		{"too short", "short", "", true},
+		{"too long", "much-too-long-a-secret", "", true},
+		{"empty", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "secret")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readSecret(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readSecret() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readSecret() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := readSecret(""); err == nil {
+		t.Error("readSecret(\"\") succeeded without a file")
+	}
+	if _, err := readSecret(filepath.Join(dir, "missing")); err == nil {
+		t.Error("readSecret() succeeded with a missing file")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/daneshih1125/docker-volume-freenas/freenas"
+)
+
+const usage = `usage: docker-volume-freenas [command]
+
+Without a command the volume plugin is started.
+
+Commands:
+  resize <volume> <size>               grow a volume to <size> GB
+  snapshot create <volume> <name>      take a snapshot of a volume
+  snapshot ls <volume>                 list the snapshots of a volume
+  snapshot rm <volume> <name>          delete a snapshot
+  snapshot rollback <volume> <name>    roll a volume back to a snapshot
+  rotate-key <volume>                  replace the LUKS key of a mounted volume
+  lock <volume>                        lock a ZFS encrypted volume
+  unlock <volume>                      unlock a ZFS encrypted volume
+  export-key <volume>                  print the key of a ZFS encrypted volume
+`
+
+// adminCall posts req to the admin API of the running plugin and decodes
+// the result into res, which may be nil.
+func adminCall(path string, req, res interface{}) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", adminSocketAddress)
+			},
+		},
+	}
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post("http://admin"+path, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var adminRes adminResponse
+	if err := json.NewDecoder(resp.Body).Decode(&adminRes); err != nil {
+		return fmt.Errorf("invalid admin API response: %s", err)
+	}
+	if adminRes.Err != "" {
+		return errors.New(adminRes.Err)
+	}
+	if res != nil && len(adminRes.Data) > 0 {
+		return json.Unmarshal(adminRes.Data, res)
+	}
+	return nil
+}
+
+func runCommand(args []string) error {
+	switch args[0] {
+	case "resize":
+		if len(args) != 3 {
+			break
+		}
+		size, err := strconv.Atoi(args[2])
+		if err != nil || size <= 0 {
+			return errors.New("Invalid size value")
+		}
+		return adminCall("/resize", &adminResizeRequest{Name: args[1], Size: size}, nil)
+	case "snapshot":
+		if len(args) < 3 {
+			break
+		}
+		req := &adminSnapshotRequest{Name: args[2]}
+		if args[1] == "ls" && len(args) == 3 {
+			var snaps []freenas.ZFSSnapshot
+			if err := adminCall("/snapshot/list", req, &snaps); err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tUSED\tREFER")
+			for _, s := range snaps {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", s.Name, s.Used, s.Refer)
+			}
+			return w.Flush()
+		}
+		if len(args) != 4 {
+			break
+		}
+		req.Snapshot = args[3]
+		switch args[1] {
+		case "create":
+			var res snapshotResult
+			if err := adminCall("/snapshot/create", req, &res); err != nil {
+				return err
+			}
+			if res.FreezeDuration != "" {
+				fmt.Printf("%s (filesystem frozen for %s)\n", res.Snapshot, res.FreezeDuration)
+			} else {
+				fmt.Println(res.Snapshot)
+			}
+			return nil
+		case "rm":
+			return adminCall("/snapshot/remove", req, nil)
+		case "rollback":
+			return adminCall("/snapshot/rollback", req, nil)
+		}
+	case "rotate-key":
+		if len(args) != 2 {
+			break
+		}
+		return adminCall("/luks/rotate", &adminVolumeRequest{Name: args[1]}, nil)
+	case "lock", "unlock":
+		if len(args) != 2 {
+			break
+		}
+		return adminCall("/zfs/"+args[0], &adminVolumeRequest{Name: args[1]}, nil)
+	case "export-key":
+		if len(args) != 2 {
+			break
+		}
+		var key string
+		if err := adminCall("/zfs/export-key", &adminVolumeRequest{Name: args[1]}, &key); err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return nil
+	}
+	fmt.Fprint(os.Stderr, usage)
+	os.Exit(2)
+	return nil
+}
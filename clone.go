@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// cloneSnapshotPrefix names the temporary snapshots taken for clones.
+const cloneSnapshotPrefix = "clone-"
+
+// cloneVolume creates the zvol of v as a ZFS clone of from, which names a
+// volume and optionally one of its snapshots as "volume[@snapshot]". Without
+// a snapshot a temporary one is taken and deleted along with the clone.
+func (d *FreeNASISCSIDriver) cloneVolume(v *FreeNASISCSIVolume, name, from string) error {
+	srcName, snap := from, ""
+	if i := strings.Index(from, "@"); i >= 0 {
+		srcName, snap = from[:i], from[i+1:]
+		if err := validSnapshotName(snap); err != nil {
+			return err
+		}
+	}
+	src, err := d.findVolume(srcName)
+	if err != nil {
+		return fmt.Errorf("source volume %s: %s", srcName, err)
+	}
+	if src.ZFSEncryption != "" {
+		return fmt.Errorf("cannot clone ZFS encrypted volume %s", srcName)
+	}
+	// without a type the clone takes the type of its source
+	if v.Type != "" && v.Type != src.Type && !(v.isBlock() && src.isBlock()) {
+		return fmt.Errorf("cannot create a %s volume from %s volume %s", v.Type, src.Type, srcName)
+	}
+	if v.Encrypt != "" && src.Encrypt != v.Encrypt {
+		return fmt.Errorf("cannot encrypt a clone of unencrypted volume %s", srcName)
+	}
+	if snap == "" {
+		snap = cloneSnapshotPrefix + name
+		if _, err := d.takeSnapshot(src, snap); err != nil {
+			return err
+		}
+		v.TemporarySnapshot = true
+	}
+	v.Type = src.Type
+	if v.Type == "" {
+		v.Type = volumeTypeISCSI
+	}
+	v.Origin = src.dataset() + "@" + snap
+	v.PoolName = src.PoolName
+	if err := d.inheritLUKS(v, src); err != nil {
+		if v.TemporarySnapshot {
+			d.freenas.DeleteZFSSnapshot(v.Origin)
+		}
+		return err
+	}
+	if err := d.freenas.CloneZFSSnapshot(v.Origin, v.dataset()); err != nil {
+		if v.TemporarySnapshot {
+			d.freenas.DeleteZFSSnapshot(v.Origin)
+		}
+		if v.Encrypt == encryptLUKS {
+			d.luksKeys(v).remove(v)
+		}
+		return err
+	}
+	if v.Size <= src.Size {
+		v.Size = src.Size
+		return nil
+	}
+	if !v.isBlock() {
+		_, err := d.freenas.UpdateZFSDataset(v.PoolName, v.Name, v.Size, v.Reservation)
+		return err
+	}
+	if _, err := d.freenas.UpdateZFSVolume(v.PoolName, v.Name, v.Size); err != nil {
+		return err
+	}
+	d.setGrowPending(v, true)
+	return nil
+}
+
+// inheritLUKS makes a clone of a LUKS volume open the cloned header. The
+// key is copied to the keyring of the clone unless the clone names its own
+// luks_key_file, so rotating the key of one volume cannot lock out the
+// other.
+func (d *FreeNASISCSIDriver) inheritLUKS(v, src *FreeNASISCSIVolume) error {
+	if src.Encrypt != encryptLUKS {
+		return nil
+	}
+	v.Encrypt = src.Encrypt
+	v.LUKSUUID = src.LUKSUUID
+	if v.LUKSKeyFile != "" {
+		return nil
+	}
+	key, err := d.luksKeys(src).key(src, false)
+	if os.IsNotExist(err) && src.LUKSUUID == "" {
+		// never mounted, the clone gets a key of its own on first mount
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read LUKS key of %s: %s", src.Name, err)
+	}
+	if err := os.MkdirAll(d.opts.Keyring, 0700); err != nil {
+		return err
+	}
+	return d.luksKeys(v).store(v, key)
+}
+
+// clonesOf returns the names of the volumes cloned from a snapshot of v.
+func (d *FreeNASISCSIDriver) clonesOf(v *FreeNASISCSIVolume) []string {
+	var clones []string
+	for name, c := range d.volumes {
+		if strings.HasPrefix(c.Origin, v.dataset()+"@") {
+			clones = append(clones, name)
+		}
+	}
+	sort.Strings(clones)
+	return clones
+}
+
+// releaseClones makes sure no volume depends on a snapshot of v before v is
+// removed. Clones are promoted when PromoteClones is set, otherwise the
+// removal is refused.
+func (d *FreeNASISCSIDriver) releaseClones(v *FreeNASISCSIVolume) error {
+	for {
+		clones := d.clonesOf(v)
+		if len(clones) == 0 {
+			return nil
+		}
+		if !d.opts.PromoteClones {
+			return errors.New(fmt.Sprintf("volume is the origin of %s, remove them first", strings.Join(clones, ", ")))
+		}
+		c := d.volumes[clones[0]]
+		log.WithField("volume", clones[0]).Infof("promoting clone of %s", v.dataset())
+		if err := d.freenas.PromoteZFSDataset(c.dataset()); err != nil {
+			return err
+		}
+		// Promotion moves the origin snapshot and every older snapshot of v
+		// to c, so the other clones of those snapshots now depend on c.
+		snaps, err := d.snapshots(c)
+		if err != nil {
+			return err
+		}
+		for _, s := range snaps {
+			for _, other := range clones[1:] {
+				o := d.volumes[other]
+				if o.Origin == v.dataset()+"@"+s.Name {
+					o.Origin = s.FullName
+				}
+			}
+		}
+		// c takes over v's place in the clone tree and v becomes a clone
+		// of the snapshot c was created from
+		origin, temporary := c.Origin, c.TemporarySnapshot
+		c.Origin, c.TemporarySnapshot = v.Origin, v.TemporarySnapshot
+		v.Origin = c.dataset() + strings.TrimPrefix(origin, v.dataset())
+		v.TemporarySnapshot = temporary
+		d.saveState()
+	}
+}
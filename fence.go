@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+// The owner of an attached iSCSI volume is recorded in the comments of its
+// zvol as "docker-volume-freenas owner=<initiator> heartbeat=<unix time>".
+// The owner refreshes the heartbeat while the volume is mounted, so a marker
+// with an old heartbeat belongs to a host that went away without unmounting.
+const ownerMarkerPrefix = "docker-volume-freenas"
+
+type ownerMarker struct {
+	Owner     string
+	Heartbeat time.Time
+}
+
+func (m ownerMarker) String() string {
+	return fmt.Sprintf("%s owner=%s heartbeat=%d", ownerMarkerPrefix, m.Owner, m.Heartbeat.Unix())
+}
+
+// parseOwnerMarker returns the zero marker when comments holds no marker.
+func parseOwnerMarker(comments string) ownerMarker {
+	var m ownerMarker
+	fields := strings.Fields(comments)
+	if len(fields) == 0 || fields[0] != ownerMarkerPrefix {
+		return m
+	}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "owner":
+			m.Owner = kv[1]
+		case "heartbeat":
+			if sec, err := strconv.ParseInt(kv[1], 10, 64); err == nil {
+				m.Heartbeat = time.Unix(sec, 0)
+			}
+		}
+	}
+	return m
+}
+
+func seconds(dur time.Duration) time.Duration {
+	return dur - dur%time.Second
+}
+
+// acquireVolume marks an iSCSI volume attached before this host logs in to
+// it, fencing it first when Fencing is set. stale reports that the last
+// owner, possibly this host before a crash, did not unmount the volume
+// cleanly; takeover that it was taken from another host with
+// force_takeover. Read-only volumes are not fenced, any number of hosts
+// may attach them.
+func (d *FreeNASISCSIDriver) acquireVolume(v *FreeNASISCSIVolume) (stale, takeover bool, err error) {
+	if !v.isBlock() || v.ReadOnly {
+		return false, false, nil
+	}
+	if d.opts.Fencing {
+		if stale, takeover, err = d.fenceVolume(v); err != nil {
+			return false, false, err
+		}
+	}
+	// the flag is only still set when this host went down with the volume
+	// attached
+	stale = stale || v.Attached
+	v.Attached = true
+	d.saveState()
+	return stale, takeover, nil
+}
+
+// fenceVolume takes the owner marker of the volume. The mount is refused
+// while another initiator is logged in to the target or holds the owner
+// marker; sessions to a shared target say nothing about its LUNs, so only
+// the marker fences those. With force_takeover the marker is taken from
+// the other owner once its heartbeat is older than TakeoverGrace, provided
+// the owner can be evicted: its reservation is preempted after login, or,
+// when it holds no session, the target is bound to this host's initiator
+// group so it cannot log in again. stale reports that a marker was left
+// behind.
+func (d *FreeNASISCSIDriver) fenceVolume(v *FreeNASISCSIVolume) (stale, takeover bool, err error) {
+	comments, err := d.freenas.GetZFSDatasetComments(v.dataset())
+	if err != nil {
+		return false, false, err
+	}
+	marker := parseOwnerMarker(comments)
+	holder, err := d.foreignSession(v, "")
+	if err != nil {
+		return false, false, err
+	}
+	live := holder != ""
+	if holder == "" && marker.Owner != "" && marker.Owner != d.initiatorName {
+		holder = "owner " + marker.Owner
+	}
+	v.takenFrom = ""
+	if holder != "" {
+		if marker.Owner == "" || marker.Owner == d.initiatorName {
+			// without a foreign marker there is no heartbeat to age the
+			// other session by
+			return false, false, fmt.Errorf("volume %s is in use by %s", v.Name, holder)
+		}
+		age := time.Since(marker.Heartbeat)
+		if !v.ForceTakeover {
+			return false, false, fmt.Errorf("volume %s is in use by %s, last heartbeat %s ago", v.Name, holder, seconds(age))
+		}
+		if age < d.opts.TakeoverGrace {
+			return false, false, fmt.Errorf("volume %s is in use by %s, takeover allowed in %s", v.Name, holder, seconds(d.opts.TakeoverGrace-age))
+		}
+		if !d.opts.PersistentReservation && (live || d.initiatorGroup == 0 || v.TargetName != "") {
+			return false, false, fmt.Errorf("volume %s is in use by %s, which cannot be fenced off for a takeover without FREENAS_PERSISTENT_RESERVATION", v.Name, holder)
+		}
+		log.WithField("volume", v.Name).Warnf("taking over from stale %s, last heartbeat %s ago", holder, seconds(age))
+		takeover = true
+		v.takenFrom = marker.Owner
+	}
+	stale = marker.Owner != ""
+	d.markerLock.Lock()
+	defer d.markerLock.Unlock()
+	marker = ownerMarker{Owner: d.initiatorName, Heartbeat: time.Now()}
+	if err := d.freenas.UpdateZFSDatasetComments(v.dataset(), marker.String()); err != nil {
+		return false, false, err
+	}
+	d.heartbeats[v.dataset()] = true
+	return stale, takeover, nil
+}
+
+// foreignSession describes a FreeNAS session to the volume's own target from
+// an initiator other than this host's and ignore, "" when there is none.
+func (d *FreeNASISCSIDriver) foreignSession(v *FreeNASISCSIVolume, ignore string) (string, error) {
+	if v.TargetName != "" {
+		return "", nil
+	}
+	sessions, err := d.freenas.GetISCSISessionList()
+	if err != nil {
+		return "", err
+	}
+	for _, s := range sessions {
+		if strings.HasSuffix(s.Target, ":"+v.Name) && s.Initiator != d.initiatorName && s.Initiator != ignore {
+			return fmt.Sprintf("initiator %s (%s)", s.Initiator, s.InitiatorAddr), nil
+		}
+	}
+	return "", nil
+}
+
+// confirmVolume checks after login that no other host fenced the volume at
+// the same time. Both hosts may have found it free and written their
+// marker; only one of them holds it now, and each sees the session of the
+// other, so at most one of them keeps the volume. The stale owner of a
+// takeover is expected to still be logged in.
+func (d *FreeNASISCSIDriver) confirmVolume(v *FreeNASISCSIVolume) error {
+	if !v.isBlock() || v.ReadOnly || !d.opts.Fencing {
+		return nil
+	}
+	comments, err := d.freenas.GetZFSDatasetComments(v.dataset())
+	if err != nil {
+		return err
+	}
+	if owner := parseOwnerMarker(comments).Owner; owner != d.initiatorName {
+		return fmt.Errorf("volume %s was claimed by %q while this host mounted it", v.Name, owner)
+	}
+	holder, err := d.foreignSession(v, v.takenFrom)
+	if err != nil {
+		return err
+	}
+	if holder != "" {
+		return fmt.Errorf("volume %s was logged in to by %s while this host mounted it", v.Name, holder)
+	}
+	return nil
+}
+
+// releaseVolume clears the attached flag and the owner marker after the
+// volume was detached. A marker another host wrote meanwhile is left alone.
+func (d *FreeNASISCSIDriver) releaseVolume(v *FreeNASISCSIVolume) error {
+	if !v.isBlock() || v.ReadOnly {
+		return nil
+	}
+	v.Attached = false
+	v.takenFrom = ""
+	d.saveState()
+	if !d.opts.Fencing {
+		return nil
+	}
+	d.markerLock.Lock()
+	defer d.markerLock.Unlock()
+	delete(d.heartbeats, v.dataset())
+	comments, err := d.freenas.GetZFSDatasetComments(v.dataset())
+	if err != nil {
+		return err
+	}
+	if owner := parseOwnerMarker(comments).Owner; owner != "" && owner != d.initiatorName {
+		return nil
+	}
+	return d.freenas.UpdateZFSDatasetComments(v.dataset(), "")
+}
+
+// runHeartbeat refreshes the owner marker of every volume attached to this
+// host. It runs without the driver lock, so a FreeNAS that does not answer
+// does not hold up Docker. It never returns.
+func (d *FreeNASISCSIDriver) runHeartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		d.markerLock.Lock()
+		datasets := make([]string, 0, len(d.heartbeats))
+		for dataset := range d.heartbeats {
+			datasets = append(datasets, dataset)
+		}
+		d.markerLock.Unlock()
+		for _, dataset := range datasets {
+			if err := d.refreshMarker(dataset); err != nil {
+				log.WithField("dataset", dataset).Error(err)
+			}
+		}
+	}
+}
+
+// refreshMarker renews the heartbeat of the owner marker on the dataset,
+// unless its volume was detached in the meantime or taken over.
+func (d *FreeNASISCSIDriver) refreshMarker(dataset string) error {
+	d.markerLock.Lock()
+	defer d.markerLock.Unlock()
+	if !d.heartbeats[dataset] {
+		return nil
+	}
+	comments, err := d.freenas.GetZFSDatasetComments(dataset)
+	if err != nil {
+		return fmt.Errorf("failed to read owner marker: %s", err)
+	}
+	if owner := parseOwnerMarker(comments).Owner; owner != "" && owner != d.initiatorName {
+		return fmt.Errorf("volume was taken over by %s", owner)
+	}
+	marker := ownerMarker{Owner: d.initiatorName, Heartbeat: time.Now()}
+	if err := d.freenas.UpdateZFSDatasetComments(dataset, marker.String()); err != nil {
+		return fmt.Errorf("failed to refresh owner marker: %s", err)
+	}
+	return nil
+}
+
+// reserveDevice registers this host's key on the LUN and takes a persistent
+// reservation of reservationType, so another host cannot write to the
+// volume even if it gets past the API side checks. The key is registered
+// through every path, since a registration only covers the path it was
+// made on. preempt takes the reservation from a stale owner after a
+// force_takeover.
+func (d *FreeNASISCSIDriver) reserveDevice(v *FreeNASISCSIVolume, paths []string, preempt bool) (err error) {
+	for _, diskpath := range paths {
+		if err := utils.RegisterPRKey(diskpath, d.opts.ReservationKey); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// a registered host that failed to reserve must not stay registered
+		for _, diskpath := range paths {
+			utils.UnregisterPRKey(diskpath, d.opts.ReservationKey)
+		}
+	}()
+	rerr := utils.ReservePR(paths[0], d.opts.ReservationKey, d.reservationType())
+	if rerr == nil {
+		return nil
+	}
+	holder, herr := utils.GetPRHolder(paths[0])
+	if herr != nil || holder == "" {
+		return fmt.Errorf("failed to reserve volume %s: %s", v.Name, rerr)
+	}
+	if !preempt {
+		return fmt.Errorf("volume %s is reserved by key %s, this host's key is %s", v.Name, holder, d.opts.ReservationKey)
+	}
+	log.WithField("volume", v.Name).Warnf("preempting the reservation of stale key %s", holder)
+	if err := utils.PreemptPR(paths[0], d.opts.ReservationKey, holder, d.reservationType()); err != nil {
+		return fmt.Errorf("failed to preempt key %s on volume %s: %s", holder, v.Name, err)
+	}
+	return nil
+}
+
+// releaseDevice releases the reservation and unregisters this host's key
+// from every path.
+func (d *FreeNASISCSIDriver) releaseDevice(v *FreeNASISCSIVolume, paths []string) error {
+	if err := utils.ReleasePR(paths[0], d.opts.ReservationKey, d.reservationType()); err != nil {
+		return err
+	}
+	for _, diskpath := range paths {
+		if err := utils.UnregisterPRKey(diskpath, d.opts.ReservationKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reservationType is Write Exclusive, or Write Exclusive - Registrants Only
+// with multipath so every registered path of the holder can write.
+func (d *FreeNASISCSIDriver) reservationType() string {
+	if d.opts.Multipath {
+		return utils.PRTypeWriteExclusiveRegistrantsOnly
+	}
+	return utils.PRTypeWriteExclusive
+}
+
+// reservationKey derives a persistent reservation key from the initiator
+// name, so it is stable across restarts and unique per host.
+func reservationKey(initiatorName string) string {
+	h := fnv.New64a()
+	h.Write([]byte(initiatorName))
+	return fmt.Sprintf("0x%x", h.Sum64())
+}
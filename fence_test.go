@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseOwnerMarker(t *testing.T) {
+	tests := []struct {
+		name     string
+		comments string
+		want     ownerMarker
+	}{
+		{"empty", "", ownerMarker{}},
+		{"other comment", "backup of the wiki", ownerMarker{}},
+		{"marker", "docker-volume-freenas owner=iqn.1993-08.org.debian:01:abc heartbeat=1500000000",
+			ownerMarker{Owner: "iqn.1993-08.org.debian:01:abc", Heartbeat: time.Unix(1500000000, 0)}},
+		{"field order", "docker-volume-freenas heartbeat=1500000000 owner=host1",
+			ownerMarker{Owner: "host1", Heartbeat: time.Unix(1500000000, 0)}},
+		{"bad heartbeat", "docker-volume-freenas owner=host1 heartbeat=soon", ownerMarker{Owner: "host1"}},
+		{"unknown fields", "docker-volume-freenas owner=host1 flag color=red", ownerMarker{Owner: "host1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseOwnerMarker(tt.comments)
+			if got.Owner != tt.want.Owner || !got.Heartbeat.Equal(tt.want.Heartbeat) {
+				t.Errorf("parseOwnerMarker(%q) = %+v, want %+v", tt.comments, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOwnerMarkerRoundTrip(t *testing.T) {
+	m := ownerMarker{Owner: "host1", Heartbeat: time.Unix(1500000000, 0)}
+	got := parseOwnerMarker(m.String())
+	if got.Owner != m.Owner || !got.Heartbeat.Equal(m.Heartbeat) {
+		t.Errorf("parseOwnerMarker(%q) = %+v, want %+v", m.String(), got, m)
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type FreeNAS struct {
@@ -19,7 +21,20 @@ type FreeNAS struct {
 	client   *http.Client
 }
 
+// The 1.0 API returns 20 objects per list request unless it is called with
+// limit=0, so every list request asks for all of them.
 const VolumeURI = "/api/v1.0/storage/volume/"
+const SnapshotURI = "/api/v1.0/storage/snapshot/"
+const ISCSISessionURI = "/api/v2.0/iscsi/global/sessions/"
+const DatasetV2URI = "/api/v2.0/pool/dataset/id/"
+const JobV2URI = "/api/v2.0/core/get_jobs"
+
+// RequestTimeout bounds every API request, so a FreeNAS that stopped
+// answering turns into an error instead of a hung caller.
+const RequestTimeout = time.Minute
+
+// JobTimeout bounds how long WaitJob waits for a job to finish.
+const JobTimeout = 5 * time.Minute
 
 type Volume struct {
 	Avail      int    `json:"avail"`
@@ -66,6 +81,43 @@ type ZVolume struct {
 	VolSize int    `json:"volsize"`
 }
 
+type ZFSSnapshot struct {
+	ID         string `json:"id"`
+	FullName   string `json:"fullname"`
+	Name       string `json:"name"`
+	Filesystem string `json:"filesystem"`
+	MostRecent bool   `json:"mostrecent"`
+	Refer      string `json:"refer"`
+	Used       string `json:"used"`
+}
+
+type Dataset struct {
+	Name       string `json:"name"`
+	Pool       string `json:"pool"`
+	MountPoint string `json:"mountpoint"`
+	Avail      int    `json:"avail"`
+	Used       int    `json:"used"`
+}
+
+type NFSShare struct {
+	ID           int      `json:"id"`
+	Paths        []string `json:"nfs_paths"`
+	Network      string   `json:"nfs_network"`
+	Comment      string   `json:"nfs_comment"`
+	MaprootUser  string   `json:"nfs_maproot_user"`
+	MaprootGroup string   `json:"nfs_maproot_group"`
+	ReadOnly     bool     `json:"nfs_ro"`
+}
+
+type SMBShare struct {
+	ID       int    `json:"id"`
+	Name     string `json:"cifs_name"`
+	Path     string `json:"cifs_path"`
+	Comment  string `json:"cifs_comment"`
+	GuestOK  bool   `json:"cifs_guestok"`
+	ReadOnly bool   `json:"cifs_ro"`
+}
+
 type Service struct {
 	Name   string `json:"srv_service"`
 	Status bool   `json:"srv_enable"`
@@ -79,9 +131,28 @@ type ISCSITarget struct {
 }
 
 type ISCSITargetGroup struct {
-	PortlID  int `json:"iscsi_target_portalgroup"`
-	TargetID int `json:"iscsi_target"`
-	ID       int `json:"id"`
+	PortlID          int    `json:"iscsi_target_portalgroup"`
+	TargetID         int    `json:"iscsi_target"`
+	InitiatorGroupID int    `json:"iscsi_target_initiatorgroup"`
+	AuthGroup        int    `json:"iscsi_target_authgroup"`
+	AuthType         string `json:"iscsi_target_authtype"`
+	ID               int    `json:"id"`
+}
+
+type ISCSIAuthCredential struct {
+	ID         int    `json:"id"`
+	Tag        int    `json:"iscsi_target_auth_tag"`
+	User       string `json:"iscsi_target_auth_user"`
+	Secret     string `json:"iscsi_target_auth_secret"`
+	PeerUser   string `json:"iscsi_target_auth_peeruser"`
+	PeerSecret string `json:"iscsi_target_auth_peersecret"`
+}
+
+type ISCSIInitiatorGroup struct {
+	ID          int    `json:"id"`
+	Initiators  string `json:"iscsi_target_initiator_initiators"`
+	AuthNetwork string `json:"iscsi_target_initiator_auth_network"`
+	Comment     string `json:"iscsi_target_initiator_comment"`
 }
 
 type ISCSIPortal struct {
@@ -94,6 +165,24 @@ type ISCSIExtent struct {
 	Type string `json:"iscsi_target_extent_type"`
 	Name string `json:"iscsi_target_extent_name"`
 	Path string `json:"iscsi_target_extent_path"`
+	// ReadOnly is set on extents exported read-only.
+	ReadOnly bool `json:"iscsi_target_extent_ro"`
+}
+
+// ISCSISession is an initiator logged in to a target. FreeNAS only exposes
+// sessions through the 2.0 API.
+type ISCSISession struct {
+	Initiator     string `json:"initiator"`
+	InitiatorAddr string `json:"initiator_addr"`
+	Target        string `json:"target"`
+	TargetAlias   string `json:"target_alias"`
+}
+
+// ISCSIGlobalConfiguration is the target global configuration. The IQN of
+// a target is the basename followed by ":" and the target name.
+type ISCSIGlobalConfiguration struct {
+	ID       int    `json:"id"`
+	Basename string `json:"iscsi_basename"`
 }
 
 type ISCSITargetToExtent struct {
@@ -110,6 +199,7 @@ func NewFreeNAS(url, username, password string) *FreeNAS {
 		password: password,
 	}
 	freenas.client = &http.Client{
+		Timeout: RequestTimeout,
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: true,
@@ -122,48 +212,44 @@ func NewFreeNAS(url, username, password string) *FreeNAS {
 func (f *FreeNAS) HttpRequest(method string, url string, body io.Reader) (response []byte, err error) {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	req.SetBasicAuth(f.username, f.password)
 	req.Header.Add("Content-Type", "application/json")
 	res, err := f.client.Do(req)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
 		return nil, errors.New("HTTP Status: " + res.Status)
 	}
 	response, err = ioutil.ReadAll(res.Body)
 	res.Body.Close()
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	return response, err
 }
 
 func (f *FreeNAS) GetVolumeList() (volumes []Volume, err error) {
-	response, err := f.HttpRequest("GET", f.url+VolumeURI, nil)
+	response, err := f.HttpRequest("GET", f.url+VolumeURI+"?limit=0", nil)
 	if err != nil {
 		return nil, err
 	}
 	if err := json.Unmarshal(response, &volumes); err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	return volumes, err
 }
 
 func (f *FreeNAS) GetZFSVolumeList(volName string) (zvols []ZVolume, err error) {
-	url := f.url + VolumeURI + volName + "/zvols/"
+	url := f.url + VolumeURI + volName + "/zvols/?limit=0"
 	response, err := f.HttpRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	if err := json.Unmarshal(response, &zvols); err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	return zvols, err
@@ -179,7 +265,20 @@ func (f *FreeNAS) CreateZFSVolume(volName, zfsVolName string, zfsVolumeSize int)
 		return zvol, err
 	}
 	if err := json.Unmarshal(response, &zvol); err != nil {
-		log.Fatal(err)
+		return zvol, err
+	}
+	return zvol, err
+}
+
+func (f *FreeNAS) UpdateZFSVolume(volName, zfsVolName string, zfsVolumeSize int) (zvol ZVolume, err error) {
+	url := f.url + VolumeURI + volName + "/zvols/" + zfsVolName + "/"
+	jsonStr := fmt.Sprintf(`{"volsize": "%dG"}`, zfsVolumeSize)
+	jsonData := []byte(jsonStr)
+	response, err := f.HttpRequest("PUT", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return zvol, err
+	}
+	if err := json.Unmarshal(response, &zvol); err != nil {
 		return zvol, err
 	}
 	return zvol, err
@@ -191,8 +290,372 @@ func (f *FreeNAS) DeleteZFSVolume(volName, zfsVolName string) (err error) {
 	return err
 }
 
+func (f *FreeNAS) GetZFSDatasetList(volName string) (datasets []Dataset, err error) {
+	url := f.url + VolumeURI + volName + "/datasets/?limit=0"
+	response, err := f.HttpRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(response, &datasets); err != nil {
+		return nil, err
+	}
+	return datasets, err
+}
+
+// CreateZFSDataset creates a dataset limited to quota GB. With reserve the
+// quota is also reserved for the dataset.
+func (f *FreeNAS) CreateZFSDataset(volName, datasetName string, quota int, reserve bool) (dataset Dataset, err error) {
+	url := f.url + VolumeURI + volName + "/datasets/"
+	jsonMap := map[string]string{
+		"name":     datasetName,
+		"refquota": fmt.Sprintf("%dG", quota),
+	}
+	if reserve {
+		jsonMap["refreservation"] = fmt.Sprintf("%dG", quota)
+	}
+	jsonData, _ := json.Marshal(jsonMap)
+	response, err := f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return dataset, err
+	}
+	if err := json.Unmarshal(response, &dataset); err != nil {
+		return dataset, err
+	}
+	return dataset, err
+}
+
+func (f *FreeNAS) UpdateZFSDataset(volName, datasetName string, quota int, reserve bool) (dataset Dataset, err error) {
+	url := f.url + VolumeURI + volName + "/datasets/" + datasetName + "/"
+	jsonMap := map[string]string{
+		"refquota": fmt.Sprintf("%dG", quota),
+	}
+	if reserve {
+		jsonMap["refreservation"] = fmt.Sprintf("%dG", quota)
+	}
+	jsonData, _ := json.Marshal(jsonMap)
+	response, err := f.HttpRequest("PUT", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return dataset, err
+	}
+	if err := json.Unmarshal(response, &dataset); err != nil {
+		return dataset, err
+	}
+	return dataset, err
+}
+
+func (f *FreeNAS) DeleteZFSDataset(volName, datasetName string) (err error) {
+	url := f.url + VolumeURI + volName + "/datasets/" + datasetName + "/"
+	_, err = f.HttpRequest("DELETE", url, nil)
+	return err
+}
+
+func (f *FreeNAS) GetZFSSnapshotList() (snapshots []ZFSSnapshot, err error) {
+	response, err := f.HttpRequest("GET", f.url+SnapshotURI+"?limit=0", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(response, &snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, err
+}
+
+func (f *FreeNAS) CreateZFSSnapshot(dataset, snapName string) (snapshot ZFSSnapshot, err error) {
+	jsonMap := map[string]string{
+		"dataset": dataset,
+		"name":    snapName,
+	}
+	jsonData, _ := json.Marshal(jsonMap)
+	response, err := f.HttpRequest("POST", f.url+SnapshotURI, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(response, &snapshot); err != nil {
+		return snapshot, err
+	}
+	return snapshot, err
+}
+
+// DeleteZFSSnapshot deletes the snapshot with the given ID, which is the
+// full "pool/dataset@name" snapshot name.
+func (f *FreeNAS) DeleteZFSSnapshot(id string) (err error) {
+	url := f.url + SnapshotURI + url.PathEscape(id) + "/"
+	_, err = f.HttpRequest("DELETE", url, nil)
+	return err
+}
+
+func (f *FreeNAS) RollbackZFSSnapshot(id string) (err error) {
+	url := f.url + SnapshotURI + url.PathEscape(id) + "/rollback/"
+	jsonData := []byte(`{"force": true}`)
+	_, err = f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
+	return err
+}
+
+// CloneZFSSnapshot creates dataset as a ZFS clone of the snapshot id.
+func (f *FreeNAS) CloneZFSSnapshot(id, dataset string) (err error) {
+	url := f.url + SnapshotURI + url.PathEscape(id) + "/clone/"
+	jsonMap := map[string]string{"name": dataset}
+	jsonData, _ := json.Marshal(jsonMap)
+	_, err = f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
+	return err
+}
+
+// GetZFSDatasetComments returns the comments property of a dataset or zvol.
+func (f *FreeNAS) GetZFSDatasetComments(dataset string) (comments string, err error) {
+	url := f.url + DatasetV2URI + url.PathEscape(dataset)
+	response, err := f.HttpRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	ds := struct {
+		Comments struct {
+			Value string `json:"value"`
+		} `json:"comments"`
+	}{}
+	if err := json.Unmarshal(response, &ds); err != nil {
+		return "", err
+	}
+	return ds.Comments.Value, err
+}
+
+func (f *FreeNAS) UpdateZFSDatasetComments(dataset, comments string) (err error) {
+	url := f.url + DatasetV2URI + url.PathEscape(dataset)
+	jsonMap := map[string]string{"comments": comments}
+	jsonData, _ := json.Marshal(jsonMap)
+	_, err = f.HttpRequest("PUT", url, bytes.NewBuffer(jsonData))
+	return err
+}
+
+// GetZFSDatasetUserProperty returns the value of the ZFS user property key
+// of a dataset or zvol, "" when it is not set.
+func (f *FreeNAS) GetZFSDatasetUserProperty(dataset, key string) (value string, err error) {
+	url := f.url + DatasetV2URI + url.PathEscape(dataset)
+	response, err := f.HttpRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	ds := struct {
+		UserProperties map[string]struct {
+			Value string `json:"value"`
+		} `json:"user_properties"`
+	}{}
+	if err := json.Unmarshal(response, &ds); err != nil {
+		return "", err
+	}
+	return ds.UserProperties[key].Value, nil
+}
+
+// GetZFSDatasetOrigin returns the "pool/dataset@snapshot" a dataset or zvol
+// was cloned from, "" when it is not a clone.
+func (f *FreeNAS) GetZFSDatasetOrigin(dataset string) (origin string, err error) {
+	url := f.url + DatasetV2URI + url.PathEscape(dataset)
+	response, err := f.HttpRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	ds := struct {
+		Origin struct {
+			Value string `json:"value"`
+		} `json:"origin"`
+	}{}
+	if err := json.Unmarshal(response, &ds); err != nil {
+		return "", err
+	}
+	return ds.Origin.Value, nil
+}
+
+// SetZFSDatasetUserProperty sets the ZFS user property key of a dataset or
+// zvol. User property keys must contain a colon.
+func (f *FreeNAS) SetZFSDatasetUserProperty(dataset, key, value string) (err error) {
+	url := f.url + DatasetV2URI + url.PathEscape(dataset)
+	jsonMap := map[string]interface{}{
+		"user_properties_update": []map[string]string{{"key": key, "value": value}},
+	}
+	jsonData, _ := json.Marshal(jsonMap)
+	_, err = f.HttpRequest("PUT", url, bytes.NewBuffer(jsonData))
+	return err
+}
+
+// PromoteZFSDataset promotes a clone so it no longer depends on its origin.
+func (f *FreeNAS) PromoteZFSDataset(dataset string) (err error) {
+	url := f.url + DatasetV2URI + url.PathEscape(dataset) + "/promote/"
+	_, err = f.HttpRequest("POST", url, nil)
+	return err
+}
+
+// ZFSEncryptionOptions are the encryption options of a new dataset or zvol.
+// With a passphrase the dataset can be locked; otherwise TrueNAS generates
+// a key and keeps it in its database.
+type ZFSEncryptionOptions struct {
+	Algorithm   string `json:"algorithm"`
+	Passphrase  string `json:"passphrase,omitempty"`
+	GenerateKey bool   `json:"generate_key,omitempty"`
+}
+
+// ZFSDatasetEncryption is the encryption state of a dataset or zvol.
+type ZFSDatasetEncryption struct {
+	Encrypted bool `json:"encrypted"`
+	Locked    bool `json:"locked"`
+	KeyFormat struct {
+		Value string `json:"value"`
+	} `json:"key_format"`
+}
+
+// Job is a TrueNAS background job, which long running 2.0 API calls return
+// the ID of.
+type Job struct {
+	ID     int             `json:"id"`
+	State  string          `json:"state"`
+	Error  string          `json:"error"`
+	Result json.RawMessage `json:"result"`
+}
+
+// WaitJob polls the job until it finished and returns it, or an error when
+// it failed or did not finish within JobTimeout.
+func (f *FreeNAS) WaitJob(id int) (job Job, err error) {
+	url := fmt.Sprintf("%s%s?id=%d", f.url, JobV2URI, id)
+	deadline := time.Now().Add(JobTimeout)
+	for {
+		response, err := f.HttpRequest("GET", url, nil)
+		if err != nil {
+			return job, err
+		}
+		var jobs []Job
+		if err := json.Unmarshal(response, &jobs); err != nil {
+			return job, err
+		}
+		if len(jobs) == 0 {
+			return job, fmt.Errorf("job %d not found", id)
+		}
+		job = jobs[0]
+		switch job.State {
+		case "SUCCESS":
+			return job, nil
+		case "FAILED", "ABORTED":
+			return job, fmt.Errorf("job %d %s: %s", id, strings.ToLower(job.State), job.Error)
+		}
+		if time.Now().After(deadline) {
+			return job, fmt.Errorf("job %d did not finish within %s, it is %s", id, JobTimeout, strings.ToLower(job.State))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// CreateEncryptedZFSDataset creates an encrypted zvol of size GiB, or a
+// filesystem dataset with a quota of size GiB, through the 2.0 API, which
+// the 1.0 API has no encryption options for.
+func (f *FreeNAS) CreateEncryptedZFSDataset(volName, name string, zvol bool, size int, reserve bool, enc ZFSEncryptionOptions) (err error) {
+	url := f.url + "/api/v2.0/pool/dataset"
+	bytesSize := int64(size) * 1024 * 1024 * 1024
+	jsonMap := map[string]interface{}{
+		"name":               volName + "/" + name,
+		"encryption":         true,
+		"inherit_encryption": false,
+		"encryption_options": enc,
+	}
+	if zvol {
+		jsonMap["type"] = "VOLUME"
+		jsonMap["volsize"] = bytesSize
+	} else {
+		jsonMap["type"] = "FILESYSTEM"
+		jsonMap["refquota"] = bytesSize
+		if reserve {
+			jsonMap["refreservation"] = bytesSize
+		}
+	}
+	jsonData, _ := json.Marshal(jsonMap)
+	_, err = f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
+	return err
+}
+
+// GetZFSDatasetEncryption returns the encryption state of a dataset.
+func (f *FreeNAS) GetZFSDatasetEncryption(dataset string) (enc ZFSDatasetEncryption, err error) {
+	url := f.url + DatasetV2URI + url.PathEscape(dataset)
+	response, err := f.HttpRequest("GET", url, nil)
+	if err != nil {
+		return enc, err
+	}
+	if err := json.Unmarshal(response, &enc); err != nil {
+		return enc, err
+	}
+	return enc, err
+}
+
+// UnlockZFSDataset unlocks a passphrase encrypted dataset and waits for the
+// unlock job.
+func (f *FreeNAS) UnlockZFSDataset(dataset, passphrase string) (err error) {
+	url := f.url + "/api/v2.0/pool/dataset/unlock"
+	jsonMap := map[string]interface{}{
+		"id": dataset,
+		"unlock_options": map[string]interface{}{
+			"datasets": []map[string]string{{"name": dataset, "passphrase": passphrase}},
+		},
+	}
+	jsonData, _ := json.Marshal(jsonMap)
+	response, err := f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	var id int
+	if err := json.Unmarshal(response, &id); err != nil {
+		return err
+	}
+	job, err := f.WaitJob(id)
+	if err != nil {
+		return err
+	}
+	result := struct {
+		Failed map[string]struct {
+			Error string `json:"error"`
+		} `json:"failed"`
+	}{}
+	if err := json.Unmarshal(job.Result, &result); err != nil {
+		return err
+	}
+	if failed, ok := result.Failed[dataset]; ok {
+		return fmt.Errorf("unlock %s: %s", dataset, failed.Error)
+	}
+	return nil
+}
+
+// LockZFSDataset locks a passphrase encrypted dataset and waits for the
+// lock job.
+func (f *FreeNAS) LockZFSDataset(dataset string) (err error) {
+	url := f.url + "/api/v2.0/pool/dataset/lock"
+	jsonMap := map[string]interface{}{
+		"id":           dataset,
+		"lock_options": map[string]bool{"force_umount": false},
+	}
+	jsonData, _ := json.Marshal(jsonMap)
+	response, err := f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	var id int
+	if err := json.Unmarshal(response, &id); err != nil {
+		return err
+	}
+	_, err = f.WaitJob(id)
+	return err
+}
+
+// ExportZFSDatasetKey returns the hex key TrueNAS generated for a dataset.
+func (f *FreeNAS) ExportZFSDatasetKey(dataset string) (key string, err error) {
+	url := f.url + "/api/v2.0/pool/dataset/export_key"
+	jsonMap := map[string]string{"id": dataset}
+	jsonData, _ := json.Marshal(jsonMap)
+	response, err := f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(response, &key); err != nil {
+		return "", err
+	}
+	return key, err
+}
+
 func (f *FreeNAS) ServicList() (services []Service, err error) {
-	url := f.url + "/api/v1.0/services/services/"
+	url := f.url + "/api/v1.0/services/services/?limit=0"
 	response, err := f.HttpRequest("GET", url, nil)
 	if err != nil {
 		return services, err
@@ -229,8 +692,86 @@ func (f *FreeNAS) UpdateService(srvName string, enable bool) (service Service, e
 	return service, err
 }
 
+func (f *FreeNAS) GetNFSShareList() (shares []NFSShare, err error) {
+	url := f.url + "/api/v1.0/sharing/nfs/?limit=0"
+	response, err := f.HttpRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(response, &shares); err != nil {
+		return nil, err
+	}
+	return shares, err
+}
+
+// CreateNFSShare shares path with the given networks, mapping root on the
+// clients to root on FreeNAS.
+func (f *FreeNAS) CreateNFSShare(path string, networks []string, comment string, readonly bool) (share NFSShare, err error) {
+	url := f.url + "/api/v1.0/sharing/nfs/"
+	share = NFSShare{
+		Paths:        []string{path},
+		Network:      strings.Join(networks, " "),
+		Comment:      comment,
+		MaprootUser:  "root",
+		MaprootGroup: "wheel",
+		ReadOnly:     readonly,
+	}
+	jsonData, _ := json.Marshal(share)
+	response, err := f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return share, err
+	}
+	if err := json.Unmarshal(response, &share); err != nil {
+		return share, err
+	}
+	return share, err
+}
+
+func (f *FreeNAS) DeleteNFSShare(id int) (err error) {
+	url := f.url + "/api/v1.0/sharing/nfs/" + fmt.Sprintf("%d/", id)
+	_, err = f.HttpRequest("DELETE", url, nil)
+	return err
+}
+
+func (f *FreeNAS) GetSMBShareList() (shares []SMBShare, err error) {
+	url := f.url + "/api/v1.0/sharing/cifs/?limit=0"
+	response, err := f.HttpRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(response, &shares); err != nil {
+		return nil, err
+	}
+	return shares, err
+}
+
+func (f *FreeNAS) CreateSMBShare(name, path, comment string, readonly bool) (share SMBShare, err error) {
+	url := f.url + "/api/v1.0/sharing/cifs/"
+	share = SMBShare{
+		Name:     name,
+		Path:     path,
+		Comment:  comment,
+		ReadOnly: readonly,
+	}
+	jsonData, _ := json.Marshal(share)
+	response, err := f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return share, err
+	}
+	if err := json.Unmarshal(response, &share); err != nil {
+		return share, err
+	}
+	return share, err
+}
+
+func (f *FreeNAS) DeleteSMBShare(id int) (err error) {
+	url := f.url + "/api/v1.0/sharing/cifs/" + fmt.Sprintf("%d/", id)
+	_, err = f.HttpRequest("DELETE", url, nil)
+	return err
+}
+
 func (f *FreeNAS) GetISCSITargetList() (targets []ISCSITarget, err error) {
-	url := f.url + "/api/v1.0/services/iscsi/target/"
+	url := f.url + "/api/v1.0/services/iscsi/target/?limit=0"
 	response, err := f.HttpRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -261,14 +802,36 @@ func (f *FreeNAS) DeleteISCSITarget(targetID int) (err error) {
 	return err
 }
 
+func (f *FreeNAS) GetISCSISessionList() (sessions []ISCSISession, err error) {
+	response, err := f.HttpRequest("GET", f.url+ISCSISessionURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(response, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, err
+}
+
+func (f *FreeNAS) GetISCSIGlobalConfiguration() (config ISCSIGlobalConfiguration, err error) {
+	url := f.url + "/api/v1.0/services/iscsi/globalconfiguration/"
+	response, err := f.HttpRequest("GET", url, nil)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(response, &config); err != nil {
+		return config, err
+	}
+	return config, err
+}
+
 func (f *FreeNAS) GetISCSIPortalList() (portals []ISCSIPortal, err error) {
-	url := f.url + "/api/v1.0/services/iscsi/portal/"
+	url := f.url + "/api/v1.0/services/iscsi/portal/?limit=0"
 	response, err := f.HttpRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	if err := json.Unmarshal(response, &portals); err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	return portals, err
@@ -283,7 +846,6 @@ func (f *FreeNAS) CreateISCSIPortal(ips []string) (portal ISCSIPortal, err error
 		return portal, err
 	}
 	if err := json.Unmarshal(response, &portal); err != nil {
-		log.Fatal(err)
 		return portal, err
 	}
 	return portal, err
@@ -296,7 +858,7 @@ func (f *FreeNAS) DeleteISCSIPortal(id int) (err error) {
 }
 
 func (f *FreeNAS) GetISCSIExtentList() (extents []ISCSIExtent, err error) {
-	url := f.url + "/api/v1.0/services/iscsi/extent/"
+	url := f.url + "/api/v1.0/services/iscsi/extent/?limit=0"
 	response, err := f.HttpRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -307,12 +869,15 @@ func (f *FreeNAS) GetISCSIExtentList() (extents []ISCSIExtent, err error) {
 	return extents, err
 }
 
-func (f *FreeNAS) CreateISCSIExtent(extentName, volName, zvolName string) (extent ISCSIExtent, err error) {
+// CreateISCSIExtent exports the zvol as an extent; a read-only extent
+// rejects writes from every initiator.
+func (f *FreeNAS) CreateISCSIExtent(extentName, volName, zvolName string, readonly bool) (extent ISCSIExtent, err error) {
 	url := f.url + "/api/v1.0/services/iscsi/extent/"
-	jsonMap := map[string]string{
+	jsonMap := map[string]interface{}{
 		"iscsi_target_extent_type": "Disk",
 		"iscsi_target_extent_name": extentName,
 		"iscsi_target_extent_disk": fmt.Sprintf("zvol/%s/%s", volName, zvolName),
+		"iscsi_target_extent_ro":   readonly,
 	}
 	jsonData, _ := json.Marshal(jsonMap)
 	response, err := f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
@@ -332,7 +897,7 @@ func (f *FreeNAS) DeleteISCSIExtent(extentID int) (err error) {
 }
 
 func (f *FreeNAS) GetISCSITargetToExtentList() (targettoextents []ISCSITargetToExtent, err error) {
-	url := f.url + "/api/v1.0/services/iscsi/targettoextent/"
+	url := f.url + "/api/v1.0/services/iscsi/targettoextent/?limit=0"
 	response, err := f.HttpRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -343,11 +908,12 @@ func (f *FreeNAS) GetISCSITargetToExtentList() (targettoextents []ISCSITargetToE
 	return targettoextents, err
 }
 
-func (f *FreeNAS) CreateISCSITargetToExtent(targetID, extentID int) (targettoextent ISCSITargetToExtent, err error) {
+func (f *FreeNAS) CreateISCSITargetToExtent(targetID, extentID, lunID int) (targettoextent ISCSITargetToExtent, err error) {
 	url := f.url + "/api/v1.0/services/iscsi/targettoextent/"
 	jsonMap := map[string]int{
 		"iscsi_target": targetID,
 		"iscsi_extent": extentID,
+		"iscsi_lunid":  lunID,
 	}
 	jsonData, _ := json.Marshal(jsonMap)
 	response, err := f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
@@ -361,13 +927,13 @@ func (f *FreeNAS) CreateISCSITargetToExtent(targetID, extentID int) (targettoext
 }
 
 func (f *FreeNAS) DeleteISCSITargetToExtent(id int) (err error) {
-	url := f.url + "/api/v1.0/services/iscsi/extent/" + fmt.Sprintf("%d/", id)
+	url := f.url + "/api/v1.0/services/iscsi/targettoextent/" + fmt.Sprintf("%d/", id)
 	_, err = f.HttpRequest("DELETE", url, nil)
 	return err
 }
 
 func (f *FreeNAS) GetISCSITargetGroupList() (targetgroups []ISCSITargetGroup, err error) {
-	url := f.url + "/api/v1.0/services/iscsi/targetgroup/"
+	url := f.url + "/api/v1.0/services/iscsi/targetgroup/?limit=0"
 	response, err := f.HttpRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -378,7 +944,11 @@ func (f *FreeNAS) GetISCSITargetGroupList() (targetgroups []ISCSITargetGroup, er
 	return targetgroups, err
 }
 
-func (f *FreeNAS) CreateISCSITargetGroup(targetID, portalID int) (targetgroup ISCSITargetGroup, err error) {
+// CreateISCSITargetGroup creates a target group. An initiatorGroupID of 0
+// allows any initiator to log in to the target. authGroup is the tag of the
+// auth credentials used with authType "CHAP" or "CHAP Mutual", an authType
+// of "" disables authentication.
+func (f *FreeNAS) CreateISCSITargetGroup(targetID, portalID, initiatorGroupID, authGroup int, authType string) (targetgroup ISCSITargetGroup, err error) {
 	url := f.url + "/api/v1.0/services/iscsi/targetgroup/"
 	jsonMap := map[string]interface{}{
 		"iscsi_target":                targetID,
@@ -388,6 +958,13 @@ func (f *FreeNAS) CreateISCSITargetGroup(targetID, portalID int) (targetgroup IS
 		"iscsi_target_authtype":       "None",
 		"iscsi_target_initialdigest":  "Auto",
 	}
+	if initiatorGroupID != 0 {
+		jsonMap["iscsi_target_initiatorgroup"] = initiatorGroupID
+	}
+	if authType != "" {
+		jsonMap["iscsi_target_authgroup"] = authGroup
+		jsonMap["iscsi_target_authtype"] = authType
+	}
 	jsonData, _ := json.Marshal(jsonMap)
 	response, err := f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
@@ -399,8 +976,100 @@ func (f *FreeNAS) CreateISCSITargetGroup(targetID, portalID int) (targetgroup IS
 	return targetgroup, err
 }
 
+// UpdateISCSITargetGroupInitiator binds the target group to another
+// initiator group, 0 allows any initiator.
+func (f *FreeNAS) UpdateISCSITargetGroupInitiator(id, initiatorGroupID int) (targetgroup ISCSITargetGroup, err error) {
+	url := f.url + "/api/v1.0/services/iscsi/targetgroup/" + fmt.Sprintf("%d/", id)
+	jsonMap := map[string]interface{}{
+		"iscsi_target_initiatorgroup": nil,
+	}
+	if initiatorGroupID != 0 {
+		jsonMap["iscsi_target_initiatorgroup"] = initiatorGroupID
+	}
+	jsonData, _ := json.Marshal(jsonMap)
+	response, err := f.HttpRequest("PUT", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return targetgroup, err
+	}
+	if err := json.Unmarshal(response, &targetgroup); err != nil {
+		return targetgroup, err
+	}
+	return targetgroup, err
+}
+
 func (f *FreeNAS) DeleteISCSITargetGroup(id int) (err error) {
 	url := f.url + "/api/v1.0/services/iscsi/targetgroup/" + fmt.Sprintf("%d/", id)
 	_, err = f.HttpRequest("DELETE", url, nil)
 	return err
 }
+
+func (f *FreeNAS) GetISCSIInitiatorGroupList() (groups []ISCSIInitiatorGroup, err error) {
+	url := f.url + "/api/v1.0/services/iscsi/authorizedinitiator/?limit=0"
+	response, err := f.HttpRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(response, &groups); err != nil {
+		return nil, err
+	}
+	return groups, err
+}
+
+// CreateISCSIInitiatorGroup creates an initiator group that allows the
+// given initiator IQNs from any network.
+func (f *FreeNAS) CreateISCSIInitiatorGroup(initiators []string, comment string) (group ISCSIInitiatorGroup, err error) {
+	url := f.url + "/api/v1.0/services/iscsi/authorizedinitiator/"
+	group = ISCSIInitiatorGroup{
+		Initiators:  strings.Join(initiators, "\n"),
+		AuthNetwork: "ALL",
+		Comment:     comment,
+	}
+	jsonData, _ := json.Marshal(group)
+	response, err := f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return group, err
+	}
+	if err := json.Unmarshal(response, &group); err != nil {
+		return group, err
+	}
+	return group, err
+}
+
+func (f *FreeNAS) GetISCSIAuthCredentialList() (creds []ISCSIAuthCredential, err error) {
+	url := f.url + "/api/v1.0/services/iscsi/authcredential/?limit=0"
+	response, err := f.HttpRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(response, &creds); err != nil {
+		return nil, err
+	}
+	return creds, err
+}
+
+func (f *FreeNAS) CreateISCSIAuthCredential(cred ISCSIAuthCredential) (created ISCSIAuthCredential, err error) {
+	url := f.url + "/api/v1.0/services/iscsi/authcredential/"
+	jsonData, _ := json.Marshal(cred)
+	response, err := f.HttpRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return created, err
+	}
+	if err := json.Unmarshal(response, &created); err != nil {
+		return created, err
+	}
+	return created, err
+}
+
+func (f *FreeNAS) UpdateISCSIAuthCredential(cred ISCSIAuthCredential) (updated ISCSIAuthCredential, err error) {
+	url := f.url + "/api/v1.0/services/iscsi/authcredential/" + fmt.Sprintf("%d/", cred.ID)
+	jsonData, _ := json.Marshal(cred)
+	response, err := f.HttpRequest("PUT", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return updated, err
+	}
+	if err := json.Unmarshal(response, &updated); err != nil {
+		return updated, err
+	}
+	return updated, err
+}
+
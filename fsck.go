@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+const (
+	fsckAuto   = "auto"
+	fsckAlways = "always"
+	fsckNever  = "never"
+)
+
+// checkFilesystem runs the filesystem checker on diskpath before the volume
+// is mounted, as its fsck policy asks: always, or with auto only when the
+// previous owner did not unmount it cleanly. The mount is refused when the
+// checker leaves errors behind.
+func (d *FreeNASISCSIDriver) checkFilesystem(v *FreeNASISCSIVolume, diskpath string, stale bool) error {
+	if v.ReadOnly {
+		// nothing can be repaired, and norecovery mounts ignore the log
+		return nil
+	}
+	switch v.FSCheck {
+	case fsckAlways:
+	case fsckAuto:
+		if !stale {
+			return nil
+		}
+	default:
+		return nil
+	}
+	logger := log.WithField("volume", v.Name)
+	fstype := utils.GetBlkDevType(diskpath)
+	if fstype == "xfs" {
+		// xfs_repair -n reports a dirty log as corruption, a mount
+		// replays it
+		if err := utils.Mount(diskpath, v.Mountpoint, "xfs", false, ""); err != nil {
+			logger.Warnf("failed to replay the XFS log: %s", err)
+		} else if err := utils.Unmount(v.Mountpoint); err != nil {
+			return err
+		}
+	}
+	logger.Infof("checking %s filesystem on %s", fstype, diskpath)
+	repaired, out, err := utils.CheckFS(diskpath, fstype)
+	v.FSCheckTime = time.Now()
+	switch {
+	case err != nil:
+		v.FSCheckResult = "errors: " + err.Error()
+		logger.Errorf("filesystem check failed: %s\n%s", err, out)
+	case repaired:
+		v.FSCheckResult = "repaired"
+		logger.Warnf("filesystem errors were repaired\n%s", out)
+	default:
+		v.FSCheckResult = "clean"
+		logger.Debug(out)
+	}
+	d.saveState()
+	if err != nil {
+		return fmt.Errorf("volume %s: filesystem check found errors it cannot repair, run the checker by hand: %s", v.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+// prepareFilesystem makes sure diskpath holds the filesystem of the volume
+// before it is mounted, and returns the device to mount. lunpath is a SCSI
+// path device of the LUN, which differs from diskpath with multipath. The
+// LUN serial, LUKS header and filesystem UUIDs are recorded when the volume
+// is formatted and checked on every later mount; a device is only
+// formatted when it is blank or allow_format was given. A clone still has
+// the filesystem UUID of its origin, so it gets a new one first.
+func (d *FreeNASISCSIDriver) prepareFilesystem(v *FreeNASISCSIVolume, diskpath, lunpath string) (string, error) {
+	serial, err := utils.GetLUNSerial(lunpath)
+	if err != nil {
+		return "", err
+	}
+	if v.LUNSerial != "" && serial != v.LUNSerial {
+		return "", fmt.Errorf("volume %s: %s is LUN %s, expected %s", v.Name, diskpath, serial, v.LUNSerial)
+	}
+	if v.LUNSerial == "" {
+		v.LUNSerial = serial
+		d.saveState()
+	}
+	fresh := false
+	if v.Encrypt == encryptLUKS {
+		if diskpath, fresh, err = d.openLUKS(v, diskpath); err != nil {
+			return "", err
+		}
+	}
+	info, err := utils.ProbeBlkDev(diskpath)
+	if err != nil {
+		return "", err
+	}
+	if v.FSUUID != "" {
+		if info.UUID != v.FSUUID {
+			return "", fmt.Errorf("volume %s: %s has filesystem UUID %q, expected %s", v.Name, diskpath, info.UUID, v.FSUUID)
+		}
+		return diskpath, nil
+	}
+
+	if v.ReadOnly && info.Type == "" {
+		return "", fmt.Errorf("volume %s is read-only and %s holds no filesystem", v.Name, diskpath)
+	}
+	if info.Type == "xfs" && v.Origin != "" && !v.ReadOnly {
+		log.WithField("volume", v.Name).Info("generating a new filesystem UUID for the clone")
+		if err := utils.RegenerateXFSUUID(diskpath); err != nil {
+			return "", err
+		}
+		if info, err = utils.ProbeBlkDev(diskpath); err != nil {
+			return "", err
+		}
+	} else if info.Type == "xfs" {
+		// formatted before identities were recorded, or by another host
+		log.WithField("volume", v.Name).Info("recording identity of existing filesystem")
+	} else {
+		// a LUKS device that was just created reads as random data
+		if !fresh {
+			if err := d.checkBlank(v, diskpath, info); err != nil {
+				return "", err
+			}
+		}
+		if err := utils.FormatXFS(diskpath, v.AllowFormat || fresh); err != nil {
+			return "", err
+		}
+		// allow_format only covers the first format
+		v.AllowFormat = false
+		if info, err = utils.ProbeBlkDev(diskpath); err != nil {
+			return "", err
+		}
+	}
+	v.FSUUID = info.UUID
+	d.saveState()
+	return diskpath, nil
+}
+
+// checkBlank refuses to format a device holding a signature or data in its
+// first MiB unless the volume allows it.
+func (d *FreeNASISCSIDriver) checkBlank(v *FreeNASISCSIVolume, diskpath string, info utils.BlkDevInfo) error {
+	if v.AllowFormat {
+		return nil
+	}
+	if info.Type != "" {
+		return fmt.Errorf("volume %s: %s holds a %s signature, refusing to format it without allow_format=true", v.Name, diskpath, info.Type)
+	}
+	zeroed, err := utils.IsBlkDevZeroed(diskpath)
+	if err != nil {
+		return err
+	}
+	if !zeroed {
+		return fmt.Errorf("volume %s: the first MiB of %s is not empty, refusing to format it without allow_format=true", v.Name, diskpath)
+	}
+	return nil
+}
+
+// openLUKS opens the LUKS device on diskpath, creating it first on a blank
+// device, and returns the mapper device. fresh reports that the LUKS
+// header was just created.
+func (d *FreeNASISCSIDriver) openLUKS(v *FreeNASISCSIVolume, diskpath string) (mapper string, fresh bool, err error) {
+	info, err := utils.ProbeBlkDev(diskpath)
+	if err != nil {
+		return "", false, err
+	}
+	keys := d.luksKeys(v)
+	switch {
+	case v.LUKSUUID != "":
+		if info.Type != "crypto_LUKS" || info.UUID != v.LUKSUUID {
+			return "", false, fmt.Errorf("volume %s: %s is %s %q, expected LUKS header %s", v.Name, diskpath, info.Type, info.UUID, v.LUKSUUID)
+		}
+	case info.Type == "crypto_LUKS":
+		log.WithField("volume", v.Name).Info("recording identity of existing LUKS header")
+	case v.ReadOnly:
+		return "", false, fmt.Errorf("volume %s is read-only and %s holds no LUKS header", v.Name, diskpath)
+	default:
+		if err := d.checkBlank(v, diskpath, info); err != nil {
+			return "", false, err
+		}
+		key, err := keys.key(v, true)
+		if err != nil {
+			return "", false, err
+		}
+		if err := utils.LUKSFormat(diskpath, key); err != nil {
+			return "", false, err
+		}
+		if info, err = utils.ProbeBlkDev(diskpath); err != nil {
+			return "", false, err
+		}
+		fresh = true
+	}
+	if v.LUKSUUID == "" {
+		v.LUKSUUID = info.UUID
+		d.saveState()
+	}
+	key, err := keys.key(v, false)
+	if err != nil {
+		return "", false, err
+	}
+	mapper, err = utils.LUKSOpen(diskpath, luksName(v), key, v.ReadOnly)
+	return mapper, fresh, err
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const initiatorGroupComment = "docker-volume-freenas "
+
+// ensureInitiatorGroup finds or creates the FreeNAS initiator group that
+// only allows this host's initiator.
+func (d *FreeNASISCSIDriver) ensureInitiatorGroup() (int, error) {
+	groups, err := d.freenas.GetISCSIInitiatorGroupList()
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range groups {
+		if g.Initiators == d.initiatorName {
+			return g.ID, nil
+		}
+	}
+	hostname, _ := os.Hostname()
+	g, err := d.freenas.CreateISCSIInitiatorGroup([]string{d.initiatorName}, initiatorGroupComment+hostname)
+	if err != nil {
+		return 0, err
+	}
+	log.WithField("initiatorGroup", g.ID).Infof("created initiator group for %s", d.initiatorName)
+	return g.ID, nil
+}
+
+// bindInitiatorGroup restricts the volume's target to this host's
+// initiator group. It is called after the volume was acquired, so the
+// binding follows the ownership of the volume.
+func (d *FreeNASISCSIDriver) bindInitiatorGroup(v *FreeNASISCSIVolume) error {
+	if d.initiatorGroup == 0 || v.TargetGroupID == 0 || v.ReadOnly {
+		return nil
+	}
+	_, err := d.freenas.UpdateISCSITargetGroupInitiator(v.TargetGroupID, d.initiatorGroup)
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const encryptLUKS = "luks"
+
+// keySize is the length of generated LUKS keys, used as binary key files.
+const keySize = 64
+
+// keyProvider supplies the LUKS keys of encrypted volumes.
+type keyProvider interface {
+	// key returns the key of the volume. With create a key is generated
+	// when the volume has none yet.
+	key(v *FreeNASISCSIVolume, create bool) ([]byte, error)
+	// store replaces the key of the volume after a rotation.
+	store(v *FreeNASISCSIVolume, key []byte) error
+	// remove forgets the key of a removed volume.
+	remove(v *FreeNASISCSIVolume) error
+}
+
+// fileKeyProvider reads the key of a volume from a file given when the
+// volume was created. The file is managed by the operator, only rotation
+// writes to it.
+type fileKeyProvider struct {
+	file string
+}
+
+func (p fileKeyProvider) key(v *FreeNASISCSIVolume, create bool) ([]byte, error) {
+	return readKey(p.file)
+}
+
+func (p fileKeyProvider) store(v *FreeNASISCSIVolume, key []byte) error {
+	return writeKey(p.file, key)
+}
+
+func (fileKeyProvider) remove(v *FreeNASISCSIVolume) error {
+	return nil
+}
+
+// keyringKeyProvider keeps a generated key per volume in a directory only
+// readable by root, named after the zvol with the extension ext.
+type keyringKeyProvider struct {
+	dir      string
+	ext      string
+	generate func() ([]byte, error)
+}
+
+func (p keyringKeyProvider) path(v *FreeNASISCSIVolume) string {
+	return filepath.Join(p.dir, v.Name+p.ext)
+}
+
+func (p keyringKeyProvider) key(v *FreeNASISCSIVolume, create bool) ([]byte, error) {
+	key, err := readKey(p.path(v))
+	if err == nil || !create || !os.IsNotExist(err) {
+		return key, err
+	}
+	if err := os.MkdirAll(p.dir, 0700); err != nil {
+		return nil, err
+	}
+	if key, err = p.generate(); err != nil {
+		return nil, err
+	}
+	return key, writeKey(p.path(v), key)
+}
+
+func (p keyringKeyProvider) store(v *FreeNASISCSIVolume, key []byte) error {
+	return writeKey(p.path(v), key)
+}
+
+func (p keyringKeyProvider) remove(v *FreeNASISCSIVolume) error {
+	err := os.Remove(p.path(v))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// luksKeys returns the provider holding the LUKS key of the volume.
+func (d *FreeNASISCSIDriver) luksKeys(v *FreeNASISCSIVolume) keyProvider {
+	if v.LUKSKeyFile != "" {
+		return fileKeyProvider{file: v.LUKSKeyFile}
+	}
+	return keyringKeyProvider{dir: d.opts.Keyring, ext: ".key", generate: newKey}
+}
+
+// zfsKeys returns the provider holding the ZFS encryption passphrase of
+// the volume.
+func (d *FreeNASISCSIDriver) zfsKeys(v *FreeNASISCSIVolume) keyProvider {
+	return keyringKeyProvider{dir: d.opts.Keyring, ext: ".zfs-passphrase", generate: newPassphrase}
+}
+
+func newKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newPassphrase returns a random passphrase; TrueNAS only accepts printable
+// passphrases.
+func newPassphrase() ([]byte, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(key[:32])), nil
+}
+
+func readKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, errors.New("key file not configured")
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// writeKey replaces the key file atomically, so a crash never leaves a
+// volume without its key.
+func writeKey(path string, key []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(key); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// luksName is the device-mapper name of the volume's open LUKS device.
+func luksName(v *FreeNASISCSIVolume) string {
+	return "freenas-" + strings.TrimPrefix(v.Name, volumePrefix)
+}
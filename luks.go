@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+// RotateKey replaces the LUKS key of an encrypted volume. The new key is
+// added to a free keyslot and stored before the old keyslot is wiped, so
+// the volume stays unlockable if the rotation is interrupted. The volume
+// must be mounted on this host.
+func (d *FreeNASISCSIDriver) RotateKey(name string) error {
+	log.WithField("method", "rotate key").Debug(name)
+
+	d.Lock()
+	defer d.Unlock()
+
+	v, err := d.findVolume(name)
+	if err != nil {
+		return err
+	}
+	if v.Encrypt != encryptLUKS {
+		return fmt.Errorf("volume %s is not encrypted", name)
+	}
+	if v.blockpath == "" {
+		return fmt.Errorf("volume %s must be mounted on this host to rotate its key", name)
+	}
+	keys := d.luksKeys(v)
+	oldKey, err := keys.key(v, false)
+	if err != nil {
+		return err
+	}
+	key, err := newKey()
+	if err != nil {
+		return err
+	}
+	if err := utils.LUKSAddKey(v.blockpath, oldKey, key); err != nil {
+		return err
+	}
+	if err := keys.store(v, key); err != nil {
+		// the old key is still valid, drop the unsaved one
+		if rerr := utils.LUKSRemoveKey(v.blockpath, key); rerr != nil {
+			log.WithField("volume", name).Errorf("failed to remove new keyslot: %s", rerr)
+		}
+		return err
+	}
+	if err := utils.LUKSRemoveKey(v.blockpath, oldKey); err != nil {
+		return fmt.Errorf("new key stored, but the old keyslot is still active: %s", err)
+	}
+	log.WithField("volume", name).Info("rotated LUKS key")
+	return nil
+}
@@ -7,9 +7,9 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,13 +25,105 @@ const iscsiService = "iscsitarget"
 type FreeNASISCSIVolume struct {
 	Size             int
 	Name             string
+	Type             string
 	Mountpoint       string
 	TargetID         int
 	ExtentID         int
 	TargetGroupID    int
 	TargetToExtentID int
 	PoolName         string
-	connections      int
+	GrowPending      bool
+
+	// TargetName is the shared target the volume is LUN LunID of, ""
+	// when the volume has a target of its own.
+	TargetName string
+	LunID      int
+
+	// AuthType is the CHAP auth type of the target group, "" without
+	// authentication.
+	AuthType string
+
+	// Origin is the "pool/zvol@snapshot" this volume was cloned from.
+	Origin            string
+	TemporarySnapshot bool
+
+	// SnapshotSchedule and SnapshotKeep are the scheduled snapshot policy,
+	// which only SnapshotHost, the initiator of the host that created the
+	// volume, runs.
+	SnapshotSchedule string
+	SnapshotKeep     int
+	SnapshotHost     string
+	LastSnapshot     time.Time
+
+	// ForceTakeover allows mounting the volume after its owner stopped
+	// refreshing its heartbeat for TakeoverGrace.
+	ForceTakeover bool
+	// Attached is set while the volume is attached to this host, so a
+	// crash is noticed on the next mount.
+	Attached bool
+
+	// FSUUID and LUNSerial identify the filesystem and the LUN of an iSCSI
+	// volume; they are recorded at format and checked on every mount.
+	// AllowFormat permits formatting a device that is not blank.
+	FSUUID      string
+	LUNSerial   string
+	AllowFormat bool
+
+	// FSCheck is the fsck policy, "auto", "always" or "never". The result
+	// of the last check is kept for the volume status.
+	FSCheck       string
+	FSCheckTime   time.Time
+	FSCheckResult string
+
+	// Encrypt is "luks" for volumes encrypted on the host. The key comes
+	// from LUKSKeyFile when set, otherwise from the keyring directory.
+	Encrypt     string
+	LUKSKeyFile string
+	LUKSUUID    string
+
+	// ReadOnly volumes are exported with a read-only extent and mounted
+	// read-only, so any number of hosts can attach them at once.
+	ReadOnly bool
+
+	// ISCSIParams are the node record parameters set with iscsi.<name>
+	// options, overriding the plugin defaults.
+	ISCSIParams map[string]string
+
+	// ZFSEncryption is the algorithm of a ZFS natively encrypted volume.
+	// ZFSKeyFormat is "passphrase", kept in the keyring, or "key", kept
+	// by TrueNAS.
+	ZFSEncryption string
+	ZFSKeyFormat  string
+
+	// ShareID, Reservation and the mount options below are used by
+	// share volumes.
+	ShareID     int
+	Reservation bool
+	NFSVersion  string
+	UID         string
+	GID         string
+	FileMode    string
+	DirMode     string
+
+	connections int
+	diskpath    string
+	// blockpath is the LUN device under diskpath, which differs from it
+	// for encrypted volumes.
+	blockpath string
+	// paths are the block devices of the iSCSI sessions behind diskpath.
+	paths []string
+	iqn   string
+	// attachment counts the mounts of the volume, so the watchdog and the
+	// snapshot scheduler can tell it was unmounted or mounted again while
+	// they worked.
+	attachment int
+	// sessionError is the session failure the watchdog could not
+	// recover, found at sessionSince.
+	sessionError string
+	sessionSince time.Time
+	// takenFrom is the initiator a force_takeover took the volume from,
+	// whose sessions may outlive the takeover.
+	takenFrom string
 }
 
 type FreeNASISCSIDriver struct {
@@ -46,9 +138,101 @@ type FreeNASISCSIDriver struct {
 	volumes       map[string]*FreeNASISCSIVolume
 	freenas       *freenas.FreeNAS
 	freenasPortal int
+	initiatorName string
+	opts          driverOptions
+
+	// targetBasename is the FreeNAS target basename, used to compute the
+	// IQN of a volume without discovery.
+	targetBasename string
+	// sharedTarget is the target new volumes are mapped to in the host
+	// and group layouts, nil in the volume layout.
+	sharedTarget *sharedTarget
+
+	// markerLock orders the owner marker writes of mount and unmount with
+	// those of the heartbeat, which runs without the driver lock.
+	// heartbeats holds the datasets whose marker the heartbeat refreshes.
+	markerLock sync.Mutex
+	heartbeats map[string]bool
+
+	// sessionLock orders the session recovery of the watchdog and the
+	// freezes of the snapshot scheduler, which run without the driver
+	// lock, with mount and unmount; the iqn and attachment of a volume
+	// only change with both locks held.
+	sessionLock sync.Mutex
+
+	// initiatorGroup is this host's FreeNAS initiator group when
+	// RestrictInitiators is set.
+	initiatorGroup int
+	// authGroup is the tag of the FreeNAS auth group with the CHAP
+	// credentials.
+	authGroup int
 }
 
-func newFreeNASISCSIDriver(root, furl, username, password string) (*FreeNASISCSIDriver, error) {
+// driverOptions holds the plugin settings read from the environment.
+type driverOptions struct {
+	// PromoteClones promotes the clones of a volume when it is removed
+	// instead of refusing to remove it.
+	PromoteClones bool
+	// FreezeTimeout bounds how long a mounted filesystem stays frozen
+	// while its snapshot is taken.
+	FreezeTimeout time.Duration
+	// NFSNetworks are the networks allowed to mount nfs volumes.
+	NFSNetworks []string
+	NFSVersion  string
+	// SMBCredentials is the cifs credentials file used to mount smb
+	// volumes.
+	SMBCredentials string
+	// Scope is "local" or "global". In global scope volumes are listed
+	// from FreeNAS, so any host can mount any volume.
+	Scope string
+	// Fencing keeps an owner marker on every attached iSCSI volume and
+	// refuses mounts while another host uses the volume. It needs the 2.0
+	// API and is on by default in global scope.
+	Fencing bool
+	// TakeoverGrace is how long the owner of a volume must have missed its
+	// heartbeat before a force_takeover volume can be taken over.
+	TakeoverGrace time.Duration
+	// PersistentReservation takes a SCSI-3 Write Exclusive reservation with
+	// ReservationKey on every mounted iSCSI volume.
+	PersistentReservation bool
+	ReservationKey        string
+	// RestrictInitiators only lets the host that owns a volume log in to
+	// its target.
+	RestrictInitiators bool
+	CHAP               chapConfig
+	// PortalIPs are the listen addresses of the portal used by the
+	// volumes' targets. When ManagePortal is set the portal is created
+	// if FreeNAS has none listening on all of them.
+	PortalIPs    []string
+	ManagePortal bool
+	// StorageAddresses are the FreeNAS addresses used for iSCSI discovery
+	// and share mounts, defaulting to the API host.
+	StorageAddresses []string
+	// Multipath logs in through every portal reported for the storage
+	// addresses and mounts the dm-multipath device combining the paths.
+	Multipath bool
+	// DeviceTimeout bounds how long a mount waits for the block device,
+	// and the multipath map, after login.
+	DeviceTimeout time.Duration
+	// Keyring is the directory holding the generated LUKS keys and ZFS
+	// passphrases of encrypted volumes.
+	Keyring string
+	// TargetLayout is "volume" for a target per volume, or "host" or
+	// "group" to map new volumes as LUNs of a target shared by this host
+	// or by the hosts of TargetGroup.
+	TargetLayout string
+	TargetGroup  string
+	// ISCSIParams are the default node record parameters of the volumes'
+	// targets, written before every login.
+	ISCSIParams map[string]string
+	// SessionCheckInterval is how often the sessions of mounted volumes
+	// are checked, 0 disables the watchdog. WebhookURL is posted to when
+	// they fail or recover.
+	SessionCheckInterval time.Duration
+	WebhookURL           string
+}
+
+func newFreeNASISCSIDriver(root, furl, username, password string, opts driverOptions) (*FreeNASISCSIDriver, error) {
 	log.WithField("method", "new driver").Debug(root)
 
 	fi, err := os.Lstat(root)
@@ -62,18 +246,33 @@ func newFreeNASISCSIDriver(root, furl, username, password string) (*FreeNASISCSI
 	}
 
 	d := &FreeNASISCSIDriver{
-		root:      filepath.Join(root, "volumes"),
-		url:       furl,
-		username:  username,
-		password:  password,
-		statePath: filepath.Join(root, "freenas-state.json"),
-		volumes:   map[string]*FreeNASISCSIVolume{},
+		root:       filepath.Join(root, "volumes"),
+		url:        furl,
+		username:   username,
+		password:   password,
+		statePath:  filepath.Join(root, "freenas-state.json"),
+		volumes:    map[string]*FreeNASISCSIVolume{},
+		heartbeats: map[string]bool{},
+		opts:       opts,
 	}
 	u, err := url.Parse(d.url)
 	if err != nil {
 		return nil, err
 	}
 	d.hostname = u.Hostname()
+	if len(d.opts.PortalIPs) == 0 {
+		d.opts.PortalIPs = []string{"0.0.0.0:3260"}
+	}
+	if len(d.opts.StorageAddresses) == 0 {
+		d.opts.StorageAddresses = []string{d.hostname}
+	}
+	d.initiatorName, err = utils.GetInitiatorName()
+	if err != nil {
+		return nil, err
+	}
+	if d.opts.ReservationKey == "" {
+		d.opts.ReservationKey = reservationKey(d.initiatorName)
+	}
 	d.freenas = freenas.NewFreeNAS(d.url, d.username, d.password)
 	iscsiSrv, err := d.freenas.ServicStatus(iscsiService)
 	if iscsiSrv.Status == false {
@@ -82,31 +281,41 @@ func newFreeNASISCSIDriver(root, furl, username, password string) (*FreeNASISCSI
 			return nil, err
 		}
 	}
-	portals, err := d.freenas.GetISCSIPortalList()
+	d.freenasPortal, err = d.findPortal()
 	if err != nil {
 		return nil, err
 	}
-	allowAny := false
-	for _, p := range portals {
-		for _, ip := range p.IPs {
-			if ip == "0.0.0.0:3260" {
-				allowAny = true
-				break
-			}
+	log.WithField("freenasPortal", d.freenasPortal).Infof("%s portal ID", strings.Join(d.opts.PortalIPs, " "))
+	if config, err := d.freenas.GetISCSIGlobalConfiguration(); err != nil {
+		log.Warnf("failed to read the target basename, volumes will be discovered: %s", err)
+	} else {
+		d.targetBasename = config.Basename
+	}
+	if d.opts.RestrictInitiators {
+		d.initiatorGroup, err = d.ensureInitiatorGroup()
+		if err != nil {
+			return nil, err
 		}
-		if allowAny == true {
-			d.freenasPortal = p.ID
-			break
+	}
+	if err := d.opts.CHAP.load(); err != nil {
+		return nil, err
+	}
+	if d.opts.CHAP.Mode != chapNone {
+		d.authGroup, err = d.ensureAuthGroup()
+		if err != nil {
+			return nil, err
 		}
 	}
-	if allowAny == false {
-		p, err := d.freenas.CreateISCSIPortal([]string{"0.0.0.0:3260"})
+	if d.opts.TargetLayout != layoutVolume {
+		name, err := sharedTargetName(d.opts)
 		if err != nil {
 			return nil, err
 		}
-		d.freenasPortal = p.ID
+		if d.sharedTarget, err = d.ensureSharedTarget(name); err != nil {
+			return nil, err
+		}
+		log.WithField("target", d.sharedTarget.ID).Infof("volumes are LUNs of %s", name)
 	}
-	log.WithField("freenasPortal", d.freenasPortal).Info("0.0.0.0:3260 portal ID")
 
 	data, err := ioutil.ReadFile(d.statePath)
 	if err != nil {
@@ -136,6 +345,59 @@ func (d *FreeNASISCSIDriver) saveState() {
 	}
 }
 
+// exportVolume creates the iSCSI target, target group, extent and mapping
+// for the volume's zvol, or the share for a share volume. In the host and
+// group layouts the extent is mapped to the shared target instead, as its
+// next free LUN.
+func (d *FreeNASISCSIDriver) exportVolume(v *FreeNASISCSIVolume) error {
+	if !v.isBlock() {
+		return d.exportShare(v)
+	}
+	if d.sharedTarget != nil && !v.ReadOnly {
+		lun, err := d.nextLunID(d.sharedTarget.ID)
+		if err != nil {
+			return err
+		}
+		v.TargetID = d.sharedTarget.ID
+		v.TargetName = d.sharedTarget.Name
+		v.AuthType = d.sharedTarget.AuthType
+		v.LunID = lun
+	} else {
+		// Create iSCSI target
+		target, err := d.freenas.CreateISCSITarget(v.Name)
+		if err != nil {
+			return err
+		}
+		v.TargetID = target.ID
+		// Create iSCSI target group
+		authType := d.opts.CHAP.authType()
+		initiatorGroup := d.initiatorGroup
+		if v.ReadOnly {
+			// every host may attach a read-only volume
+			initiatorGroup = 0
+		}
+		tgroup, err := d.freenas.CreateISCSITargetGroup(target.ID, d.freenasPortal, initiatorGroup, d.authGroup, authType)
+		if err != nil {
+			return err
+		}
+		v.TargetGroupID = tgroup.ID
+		v.AuthType = authType
+	}
+	// Create iSCSI extent
+	extent, err := d.freenas.CreateISCSIExtent(v.Name, v.PoolName, v.Name, v.ReadOnly)
+	if err != nil {
+		return err
+	}
+	v.ExtentID = extent.ID
+	// Create iSCSI target to extent
+	targettoextent, err := d.freenas.CreateISCSITargetToExtent(v.TargetID, extent.ID, v.LunID)
+	if err != nil {
+		return err
+	}
+	v.TargetToExtentID = targettoextent.ID
+	return nil
+}
+
 func (d *FreeNASISCSIDriver) Create(r *volume.CreateRequest) error {
 	log.WithField("method", "create").Debugf("%#v", r)
 
@@ -143,61 +405,140 @@ func (d *FreeNASISCSIDriver) Create(r *volume.CreateRequest) error {
 	defer d.Unlock()
 	v := &FreeNASISCSIVolume{}
 
+	var from string
 	for key, val := range r.Options {
-		if key == "size" {
+		switch key {
+		case "size":
 			v.Size, _ = strconv.Atoi(val)
+		case "from":
+			from = val
+		case "type":
+			if val != volumeTypeISCSI && val != volumeTypeNFS && val != volumeTypeSMB {
+				return errors.New("Invalid type value")
+			}
+			v.Type = val
+		case "force_takeover":
+			v.ForceTakeover = val == "true"
+		case "fsck":
+			if val != fsckAuto && val != fsckAlways && val != fsckNever {
+				return errors.New("Invalid fsck value")
+			}
+			v.FSCheck = val
+		case "encrypt":
+			if val != encryptLUKS {
+				return errors.New("Invalid encrypt value")
+			}
+			v.Encrypt = val
+		case "luks_key_file":
+			v.LUKSKeyFile = val
+		case "zfs_encryption":
+			alg, err := parseZFSEncryption(val)
+			if err != nil {
+				return err
+			}
+			v.ZFSEncryption = alg
+		case "zfs_key_format":
+			if val != zfsKeyPassphrase && val != zfsKeyHex {
+				return errors.New("Invalid zfs_key_format value")
+			}
+			v.ZFSKeyFormat = val
+		case "readonly":
+			v.ReadOnly = val == "true"
+		case "allow_format":
+			v.AllowFormat = val == "true"
+		case "reservation":
+			v.Reservation = val == "true"
+		case "nfs_version":
+			if val != "3" && val != "4" && !strings.HasPrefix(val, "4.") {
+				return errors.New("Invalid nfs_version value")
+			}
+			v.NFSVersion = val
+		case "uid", "gid", "file_mode", "dir_mode":
+			if err := v.parseShareOption(key, val); err != nil {
+				return err
+			}
+		case "snapshot_schedule":
+			if _, err := snapshotPeriod(val); err != nil {
+				return err
+			}
+			v.SnapshotSchedule = val
+			v.SnapshotHost = d.initiatorName
+		case "snapshot_keep":
+			keep, err := strconv.Atoi(val)
+			if err != nil || keep < 0 {
+				return errors.New("Invalid snapshot_keep value")
+			}
+			v.SnapshotKeep = keep
+		default:
+			if !strings.HasPrefix(key, iscsiParamPrefix) {
+				break
+			}
+			name := strings.TrimPrefix(key, iscsiParamPrefix)
+			if err := checkISCSIParam(name, val); err != nil {
+				return err
+			}
+			if v.ISCSIParams == nil {
+				v.ISCSIParams = map[string]string{}
+			}
+			v.ISCSIParams[name] = val
 		}
 	}
-	if v.Size == 0 {
-		return errors.New("Invalid size value")
-	}
-	// find the volume that has maximum available size
-	volume := freenas.Volume{}
-	freeVols, err := d.freenas.GetVolumeList()
-	for _, vol := range freeVols {
-		if vol.Avail > volume.Avail {
-			volume = vol
-		}
-	}
-	if volume.Avail < 1024*1024*1024*v.Size {
-		return errors.New("Insufficient volume size")
-	}
 	// FreeNAS iscsi volume name
 	v.Name = "docker-" + r.Name
-	v.PoolName = volume.Name
-	// Create ZVOL
-	_, err = d.freenas.CreateZFSVolume(volume.Name, v.Name, v.Size)
-	if err != nil {
-		return err
+	if v.Type == "" && from == "" {
+		v.Type = volumeTypeISCSI
 	}
-	// Create iSCSI target
-	target, err := d.freenas.CreateISCSITarget(v.Name)
-	if err != nil {
-		return err
+	if v.ZFSEncryption != "" && v.ZFSKeyFormat == "" {
+		v.ZFSKeyFormat = zfsKeyPassphrase
 	}
-	v.TargetID = target.ID
-	// Create iSCSI target group
-	tgroup, err := d.freenas.CreateISCSITargetGroup(target.ID, d.freenasPortal)
-	if err != nil {
-		return err
+	if v.ReadOnly && from == "" {
+		return errors.New("a readonly volume must be created with from, it cannot be formatted")
 	}
-	v.TargetGroupID = tgroup.ID
-	// Create iSCSI extent
-	extent, err := d.freenas.CreateISCSIExtent(v.Name, volume.Name, v.Name)
-	if err != nil {
-		return err
+	if from != "" {
+		if v.ZFSEncryption != "" {
+			return errors.New("a clone cannot set zfs_encryption")
+		}
+		if err := d.cloneVolume(v, r.Name, from); err != nil {
+			return err
+		}
+	} else {
+		if v.Size == 0 {
+			return errors.New("Invalid size value")
+		}
+		// find the volume that has maximum available size
+		volume := freenas.Volume{}
+		freeVols, err := d.freenas.GetVolumeList()
+		if err != nil {
+			return err
+		}
+		for _, vol := range freeVols {
+			if vol.Avail > volume.Avail {
+				volume = vol
+			}
+		}
+		if volume.Avail < 1024*1024*1024*v.Size {
+			return errors.New("Insufficient volume size")
+		}
+		v.PoolName = volume.Name
+		if v.ZFSEncryption != "" {
+			err = d.createEncryptedDataset(v)
+		} else if v.isBlock() {
+			// Create ZVOL
+			_, err = d.freenas.CreateZFSVolume(volume.Name, v.Name, v.Size)
+		} else {
+			_, err = d.freenas.CreateZFSDataset(volume.Name, v.Name, v.Size, v.Reservation)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	v.ExtentID = extent.ID
-	// Create iSCSI target to extent
-	targettoextent, err := d.freenas.CreateISCSITargetToExtent(target.ID, extent.ID)
-	if err != nil {
+	if err := d.exportVolume(v); err != nil {
 		return err
 	}
-	v.TargetToExtentID = targettoextent.ID
-	v.Mountpoint = filepath.Join(d.root, r.Name)
-	if err != nil {
-		return err
+	if err := d.saveOptions(v); err != nil {
+		log.WithField("volume", v.Name).Warnf("failed to save volume options, other hosts use the defaults: %s", err)
 	}
+	v.Mountpoint = filepath.Join(d.root, r.Name)
 	d.volumes[r.Name] = v
 	d.saveState()
 	return nil
@@ -209,6 +550,13 @@ func (d *FreeNASISCSIDriver) List() (*volume.ListResponse, error) {
 	d.Lock()
 	defer d.Unlock()
 
+	if d.opts.Scope == scopeGlobal {
+		vols, err := d.listGlobal()
+		if err != nil {
+			return &volume.ListResponse{}, err
+		}
+		return &volume.ListResponse{Volumes: vols}, nil
+	}
 	var vols []*volume.Volume
 	for name, v := range d.volumes {
 		vols = append(vols, &volume.Volume{Name: name, Mountpoint: v.Mountpoint})
@@ -222,12 +570,12 @@ func (d *FreeNASISCSIDriver) Get(r *volume.GetRequest) (*volume.GetResponse, err
 	d.Lock()
 	defer d.Unlock()
 
-	v, ok := d.volumes[r.Name]
-	if !ok {
-		return &volume.GetResponse{}, errors.New("volume not found")
+	v, err := d.findVolume(r.Name)
+	if err != nil {
+		return &volume.GetResponse{}, err
 	}
 
-	return &volume.GetResponse{Volume: &volume.Volume{Name: r.Name, Mountpoint: v.Mountpoint}}, nil
+	return &volume.GetResponse{Volume: &volume.Volume{Name: r.Name, Mountpoint: v.Mountpoint, Status: d.volumeStatus(v)}}, nil
 }
 
 func (d *FreeNASISCSIDriver) Remove(r *volume.RemoveRequest) error {
@@ -236,19 +584,74 @@ func (d *FreeNASISCSIDriver) Remove(r *volume.RemoveRequest) error {
 	d.Lock()
 	defer d.Unlock()
 
-	v, ok := d.volumes[r.Name]
-	if !ok {
-		return errors.New("Volume not found")
+	v, err := d.findVolume(r.Name)
+	if err != nil {
+		return err
 	}
 
 	if v.connections != 0 {
 		return errors.New(fmt.Sprintf("volume %s is currently used by a container", r.Name))
 	}
-	d.freenas.DeleteISCSITargetToExtent(v.TargetToExtentID)
-	d.freenas.DeleteISCSIExtent(v.ExtentID)
-	d.freenas.DeleteISCSITargetGroup(v.TargetGroupID)
-	d.freenas.DeleteISCSITarget(v.TargetID)
-	d.freenas.DeleteZFSVolume(v.PoolName, v.Name)
+	if d.opts.Scope == scopeGlobal {
+		attached, err := d.volumeAttached(v)
+		if err != nil {
+			return err
+		}
+		if attached {
+			return errors.New(fmt.Sprintf("volume %s is currently used by another host", r.Name))
+		}
+		if err := d.discoverRemoteVolumes(); err != nil {
+			return err
+		}
+	}
+	if err := d.releaseClones(v); err != nil {
+		return err
+	}
+	if v.isBlock() {
+		d.freenas.DeleteISCSITargetToExtent(v.TargetToExtentID)
+		d.freenas.DeleteISCSIExtent(v.ExtentID)
+		if v.TargetName == "" {
+			// a shared target stays for the other LUNs
+			d.freenas.DeleteISCSITargetGroup(v.TargetGroupID)
+			d.freenas.DeleteISCSITarget(v.TargetID)
+		}
+		d.removeSnapshots(v)
+		d.lockRemovedDataset(v)
+		err = d.freenas.DeleteZFSVolume(v.PoolName, v.Name)
+	} else {
+		if err := d.unexportShare(v); err != nil {
+			log.WithField("volume", v.Name).Error(err)
+		}
+		d.removeSnapshots(v)
+		d.lockRemovedDataset(v)
+		err = d.freenas.DeleteZFSDataset(v.PoolName, v.Name)
+	}
+	if err != nil {
+		// the zvol or dataset is still there, so export it again rather
+		// than leave a volume that can neither be mounted nor removed
+		if eerr := d.exportVolume(v); eerr != nil {
+			log.WithField("volume", v.Name).Errorf("failed to export the volume again: %s", eerr)
+		}
+		d.saveState()
+		return fmt.Errorf("failed to delete volume %s: %s", r.Name, err)
+	}
+	if v.ZFSKeyFormat == zfsKeyPassphrase {
+		// the passphrase is only forgotten once the data is gone
+		if err := d.zfsKeys(v).remove(v); err != nil {
+			log.WithField("volume", v.Name).Errorf("failed to remove ZFS passphrase: %s", err)
+		}
+	}
+	if v.Encrypt == encryptLUKS {
+		// like the passphrase, the key is only forgotten once the data is gone
+		if err := d.luksKeys(v).remove(v); err != nil {
+			log.WithField("volume", v.Name).Errorf("failed to remove LUKS key: %s", err)
+		}
+	}
+	if v.TemporarySnapshot {
+		if err := d.freenas.DeleteZFSSnapshot(v.Origin); err != nil {
+			log.WithField("snapshot", v.Origin).Error(err)
+		}
+	}
 	delete(d.volumes, r.Name)
 	d.saveState()
 	return nil
@@ -268,32 +671,109 @@ func (d *FreeNASISCSIDriver) Path(r *volume.PathRequest) (*volume.PathResponse,
 	return &volume.PathResponse{Mountpoint: v.Mountpoint}, nil
 }
 
-func (d *FreeNASISCSIDriver) mountVolume(v *FreeNASISCSIVolume) error {
-	iqn, err := utils.FindISCSIIQN(d.hostname, v.Name)
+// mountVolume attaches the volume and mounts it. When a step fails the
+// steps before it are undone in reverse order, so a failed mount leaves no
+// owner marker, session, reservation or LUKS mapping behind.
+func (d *FreeNASISCSIDriver) mountVolume(v *FreeNASISCSIVolume) (err error) {
+	if err := d.unlockDataset(v); err != nil {
+		return err
+	}
+	if !v.isBlock() {
+		return d.mountShare(v)
+	}
+	var undo []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if uerr := undo[i](); uerr != nil {
+				log.WithField("volume", v.Name).Errorf("failed to clean up after the failed mount: %s", uerr)
+			}
+		}
+	}()
+	stale, takeover, err := d.acquireVolume(v)
 	if err != nil {
 		return err
 	}
-	utils.LoginISCSITarget(iqn)
-	diskpath, err := utils.GetISCSIDiskPath(d.hostname, v.Name)
+	undo = append(undo, func() error { return d.releaseVolume(v) })
+	// binding the target to this host's initiator group keeps the stale
+	// owner from logging in again
+	if err := d.bindInitiatorGroup(v); err != nil {
+		return err
+	}
+	iqn, paths, err := d.findTarget(v)
 	if err != nil {
 		return err
 	}
-	for i := 0; i < 5; i++ {
-		if _, err := os.Stat(diskpath); os.IsNotExist(err) {
-			time.Sleep(time.Second)
-			continue
-		} else {
-			break
+	if err := d.applyNodeAuth(v, iqn); err != nil {
+		return err
+	}
+	if err := d.applyNodeParams(v, iqn); err != nil {
+		return err
+	}
+	if err := d.loginTarget(iqn, len(paths)); err != nil {
+		return err
+	}
+	var devices []string
+	undo = append(undo, func() error { return d.logoutTarget(v, iqn, devices) })
+	if devices, err = utils.WaitISCSIDevices(iqn, v.LunID, len(paths), d.opts.DeviceTimeout); err != nil {
+		return fmt.Errorf("volume %s: %s", v.Name, err)
+	}
+	if err := d.confirmVolume(v); err != nil {
+		return err
+	}
+	diskpath := devices[0]
+	if d.opts.Multipath {
+		if diskpath, err = utils.WaitMultipathDevice(devices, d.opts.DeviceTimeout); err != nil {
+			return err
 		}
+		mapper := diskpath
+		undo = append(undo, func() error { return utils.FlushMultipath(mapper) })
 	}
-	if utils.GetBlkDevType(diskpath) != "xfs" {
-		err = utils.FormatXFS(diskpath)
+	if d.opts.PersistentReservation && !v.ReadOnly {
+		if err := d.reserveDevice(v, devices, takeover); err != nil {
+			return err
+		}
+		undo = append(undo, func() error { return d.releaseDevice(v, devices) })
 	}
-	if err != nil {
+	if v.Encrypt == encryptLUKS {
+		// prepareFilesystem opens the mapping
+		undo = append(undo, func() error { return utils.LUKSClose(luksName(v)) })
+	}
+	blockpath := diskpath
+	if diskpath, err = d.prepareFilesystem(v, blockpath, devices[0]); err != nil {
+		return err
+	}
+	if err := d.checkFilesystem(v, diskpath, stale); err != nil {
 		return err
 	}
-	cmd := fmt.Sprintf("mount %s %s", diskpath, v.Mountpoint)
-	return exec.Command("sh", "-c", cmd).Run()
+	var data string
+	if v.ReadOnly {
+		// a dirty log cannot be replayed on a read-only LUN, nor can the
+		// UUID it shares with its origin be changed
+		data = "norecovery,nouuid"
+	}
+	if err := utils.Mount(diskpath, v.Mountpoint, "xfs", v.ReadOnly, data); err != nil {
+		return err
+	}
+	v.diskpath = diskpath
+	v.blockpath = blockpath
+	v.paths = devices
+	d.sessionLock.Lock()
+	v.iqn = iqn
+	v.attachment++
+	d.sessionLock.Unlock()
+	if !v.ReadOnly && d.growPending(v) {
+		// the zvol was resized while it was not attached to this host
+		if err := utils.GrowFS(diskpath, v.Mountpoint); err != nil {
+			log.WithField("volume", v.Name).Error(err)
+		} else {
+			d.setGrowPending(v, false)
+			d.saveState()
+		}
+	}
+	return nil
 }
 
 func (d *FreeNASISCSIDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
@@ -302,10 +782,9 @@ func (d *FreeNASISCSIDriver) Mount(r *volume.MountRequest) (*volume.MountRespons
 	d.Lock()
 	defer d.Unlock()
 
-	v, ok := d.volumes[r.Name]
-	if !ok {
-		log.Fatal("Volume not fount")
-		return &volume.MountResponse{}, errors.New("Volume not found")
+	v, err := d.findVolume(r.Name)
+	if err != nil {
+		return &volume.MountResponse{}, err
 	}
 	if v.connections == 0 {
 		fi, err := os.Lstat(v.Mountpoint)
@@ -333,13 +812,46 @@ func (d *FreeNASISCSIDriver) Mount(r *volume.MountRequest) (*volume.MountRespons
 }
 
 func (d *FreeNASISCSIDriver) unmountVolume(v *FreeNASISCSIVolume) error {
-	iqn, err := utils.FindISCSIIQN(d.hostname, v.Name)
-	cmd := fmt.Sprintf("umount %s", v.Mountpoint)
-	err = exec.Command("sh", "-c", cmd).Run()
-	if err != nil {
+	if !v.isBlock() {
+		return utils.Unmount(v.Mountpoint)
+	}
+	// waits for a running recovery or a scheduled snapshot, after which
+	// the watchdog and the scheduler leave the volume alone
+	d.sessionLock.Lock()
+	if err := utils.Unmount(v.Mountpoint); err != nil {
+		d.sessionLock.Unlock()
+		// a lazily detached filesystem still needs its device
 		return err
 	}
-	return utils.LogoutISCSITarget(iqn)
+	iqn, paths := v.iqn, v.paths
+	v.iqn = ""
+	v.attachment++
+	d.sessionLock.Unlock()
+	v.paths = nil
+	v.sessionError = ""
+	if d.opts.PersistentReservation && !v.ReadOnly && len(paths) != 0 {
+		if err := d.releaseDevice(v, paths); err != nil {
+			log.WithField("volume", v.Name).Errorf("failed to release reservation: %s", err)
+		}
+	}
+	if v.Encrypt == encryptLUKS {
+		if err := utils.LUKSClose(luksName(v)); err != nil {
+			return err
+		}
+	}
+	if d.opts.Multipath && v.blockpath != "" {
+		// the map must go before its paths, or multipathd keeps queueing
+		// I/O for the logged out sessions
+		if err := utils.FlushMultipath(v.blockpath); err != nil {
+			return err
+		}
+	}
+	v.diskpath = ""
+	v.blockpath = ""
+	if err := d.logoutTarget(v, iqn, paths); err != nil {
+		return err
+	}
+	return d.releaseVolume(v)
 }
 
 func (d *FreeNASISCSIDriver) Unmount(r *volume.UnmountRequest) error {
@@ -365,23 +877,139 @@ func (d *FreeNASISCSIDriver) Capabilities() *volume.CapabilitiesResponse {
 	log.WithField("method", "capabilities").Debugf("")
 
 	return &volume.CapabilitiesResponse{
-		Capabilities: volume.Capability{Scope: "local"},
+		Capabilities: volume.Capability{Scope: d.opts.Scope},
+	}
+}
+
+// envDuration parses the environment variable name as a time.Duration and
+// falls back to def when it is unset.
+func envDuration(name string, def time.Duration) time.Duration {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	dur, err := time.ParseDuration(val)
+	if err != nil {
+		log.Fatalf("Invalid environment variable %s: %s", name, err)
+	}
+	return dur
+}
+
+// envList splits the comma separated environment variable name.
+func envList(name string) []string {
+	var list []string
+	for _, val := range strings.Split(os.Getenv(name), ",") {
+		if val = strings.TrimSpace(val); val != "" {
+			list = append(list, val)
+		}
 	}
+	return list
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	apiURL := os.Getenv("FREENAS_API_URL")
 	apiUsername := os.Getenv("FREENAS_API_USER")
 	apiPassword := os.Getenv("FREENAS_API_PASSWORD")
 	if apiURL == "" || apiUsername == "" || apiPassword == "" {
 		log.Fatal("Invalid environment variables: FREENAS_API_URL, FREENAS_API_USER, FREENAS_API_PASSWORD")
 	}
-	d, err := newFreeNASISCSIDriver("/mnt/freenas", apiURL, apiUsername, apiPassword)
+	opts := driverOptions{
+		PromoteClones:         os.Getenv("FREENAS_PROMOTE_CLONES") == "true",
+		FreezeTimeout:         envDuration("FREENAS_FREEZE_TIMEOUT", 30*time.Second),
+		NFSNetworks:           envList("FREENAS_NFS_NETWORKS"),
+		NFSVersion:            os.Getenv("FREENAS_NFS_VERSION"),
+		SMBCredentials:        os.Getenv("FREENAS_SMB_CREDENTIALS"),
+		Scope:                 os.Getenv("FREENAS_SCOPE"),
+		TakeoverGrace:         envDuration("FREENAS_TAKEOVER_GRACE", 5*time.Minute),
+		PersistentReservation: os.Getenv("FREENAS_PERSISTENT_RESERVATION") == "true",
+		ReservationKey:        os.Getenv("FREENAS_RESERVATION_KEY"),
+		RestrictInitiators:    os.Getenv("FREENAS_RESTRICT_INITIATORS") == "true",
+		PortalIPs:             envList("FREENAS_PORTAL_IPS"),
+		ManagePortal:          os.Getenv("FREENAS_MANAGE_PORTAL") != "false",
+		StorageAddresses:      envList("FREENAS_STORAGE_ADDRESSES"),
+		Multipath:             os.Getenv("FREENAS_MULTIPATH") == "true",
+		DeviceTimeout:         envDuration("FREENAS_DEVICE_TIMEOUT", 30*time.Second),
+		Keyring:               os.Getenv("FREENAS_KEYRING"),
+		TargetLayout:          os.Getenv("FREENAS_TARGET_LAYOUT"),
+		TargetGroup:           os.Getenv("FREENAS_TARGET_GROUP"),
+		SessionCheckInterval:  envDuration("FREENAS_SESSION_CHECK_INTERVAL", 30*time.Second),
+		WebhookURL:            os.Getenv("FREENAS_WEBHOOK_URL"),
+		CHAP: chapConfig{
+			Mode:           os.Getenv("FREENAS_CHAP"),
+			User:           os.Getenv("FREENAS_CHAP_USER"),
+			SecretFile:     os.Getenv("FREENAS_CHAP_SECRET_FILE"),
+			PeerUser:       os.Getenv("FREENAS_CHAP_PEER_USER"),
+			PeerSecretFile: os.Getenv("FREENAS_CHAP_PEER_SECRET_FILE"),
+		},
+	}
+	switch opts.Scope {
+	case "":
+		opts.Scope = scopeLocal
+	case scopeLocal, scopeGlobal:
+	default:
+		log.Fatal("Invalid environment variable FREENAS_SCOPE: use local or global")
+	}
+	switch os.Getenv("FREENAS_FENCING") {
+	case "":
+		opts.Fencing = opts.Scope == scopeGlobal
+	case "true":
+		opts.Fencing = true
+	case "false":
+	default:
+		log.Fatal("Invalid environment variable FREENAS_FENCING: use true or false")
+	}
+	if opts.Fencing && opts.TakeoverGrace < 3*time.Second {
+		// the heartbeat runs three times per grace period
+		log.Fatal("Invalid environment variable FREENAS_TAKEOVER_GRACE: use at least 3s")
+	}
+	switch opts.TargetLayout {
+	case "":
+		opts.TargetLayout = layoutVolume
+	case layoutVolume, layoutHost:
+	case layoutGroup:
+		if opts.TargetGroup == "" {
+			log.Fatal("Invalid environment variables: FREENAS_TARGET_LAYOUT=group needs FREENAS_TARGET_GROUP")
+		}
+	default:
+		log.Fatal("Invalid environment variable FREENAS_TARGET_LAYOUT: use volume, host or group")
+	}
+	iscsiParams, err := parseISCSIParams(envList("FREENAS_ISCSI_PARAMS"))
+	if err != nil {
+		log.Fatalf("Invalid environment variable FREENAS_ISCSI_PARAMS: %s", err)
+	}
+	opts.ISCSIParams = iscsiParams
+	if opts.NFSVersion == "" {
+		opts.NFSVersion = "4"
+	}
+	if opts.SMBCredentials == "" {
+		opts.SMBCredentials = "/etc/docker-volume-freenas/smb-credentials"
+	}
+	if opts.Keyring == "" {
+		opts.Keyring = "/etc/docker-volume-freenas/keys"
+	}
+	d, err := newFreeNASISCSIDriver("/mnt/freenas", apiURL, apiUsername, apiPassword, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 	h := volume.NewHandler(d)
 	log.SetLevel(log.DebugLevel)
+	go d.runSnapshotScheduler(time.Minute)
+	if opts.Fencing {
+		go d.runHeartbeat(opts.TakeoverGrace / 3)
+	}
+	if opts.SessionCheckInterval > 0 {
+		go d.runSessionWatchdog(opts.SessionCheckInterval)
+	}
+	go func() {
+		log.Infof("admin API listening on %s", adminSocketAddress)
+		log.Error(d.serveAdmin(adminSocketAddress))
+	}()
 	log.Infof("listening on %s", socketAddress)
 	log.Error(h.ServeUnix(socketAddress, 0))
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+// iscsiParamPrefix starts the volume options that set a parameter of the
+// iSCSI node record, e.g. iscsi.node.session.timeo.replacement_timeout=120.
+const iscsiParamPrefix = "iscsi."
+
+// reservedISCSIParams identify the node record or hold the CHAP
+// credentials, which the plugin manages itself.
+var reservedISCSIParams = []string{"node.name", "node.tpgt", "node.conn[0].address", "node.conn[0].port", "node.session.auth."}
+
+// checkISCSIParam validates a node record parameter as iscsiadm names it.
+func checkISCSIParam(name, value string) error {
+	if !strings.HasPrefix(name, "node.") {
+		return fmt.Errorf("invalid iSCSI parameter %s, use a node record parameter like node.session.cmds_max", name)
+	}
+	for _, r := range reservedISCSIParams {
+		if name == r || strings.HasSuffix(r, ".") && strings.HasPrefix(name, r) {
+			return fmt.Errorf("iSCSI parameter %s is managed by the plugin", name)
+		}
+	}
+	if value == "" || strings.ContainsAny(value, " \t\n") {
+		return fmt.Errorf("invalid value %q for iSCSI parameter %s", value, name)
+	}
+	return nil
+}
+
+// parseISCSIParams parses the name=value node record parameters of
+// FREENAS_ISCSI_PARAMS.
+func parseISCSIParams(list []string) (map[string]string, error) {
+	params := map[string]string{}
+	for _, p := range list {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid iSCSI parameter %q, use name=value", p)
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if err := checkISCSIParam(name, value); err != nil {
+			return nil, err
+		}
+		params[name] = value
+	}
+	return params, nil
+}
+
+// nodeParams returns the plugin defaults overridden by the parameters of
+// the volume.
+func (d *FreeNASISCSIDriver) nodeParams(v *FreeNASISCSIVolume) map[string]string {
+	params := map[string]string{}
+	for name, value := range d.opts.ISCSIParams {
+		params[name] = value
+	}
+	for name, value := range v.ISCSIParams {
+		params[name] = value
+	}
+	return params
+}
+
+// applyNodeParams writes the session parameters of the volume to the node
+// record of the target before login, so they are set again on every
+// mount even if the record was recreated.
+func (d *FreeNASISCSIDriver) applyNodeParams(v *FreeNASISCSIVolume, iqn string) error {
+	params := d.nodeParams(v)
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := utils.UpdateISCSINode(iqn, name, params[name]); err != nil {
+			return fmt.Errorf("volume %s: %s", v.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckISCSIParam(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"node.session.timeo.replacement_timeout", "120", false},
+		{"node.session.cmds_max", "256", false},
+		{"node.startup", "manual", false},
+		{"discovery.sendtargets.auth.authmethod", "CHAP", true},
+		{"node.name", "iqn.2005-10.org.freenas.ctl:other", true},
+		{"node.conn[0].address", "10.0.0.1", true},
+		{"node.session.auth.password", "averylongsecret", true},
+		{"node.session.queue_depth", "", true},
+		{"node.session.queue_depth", "32 64", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"="+tt.value, func(t *testing.T) {
+			err := checkISCSIParam(tt.name, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkISCSIParam(%q, %q) error = %v, want error %v", tt.name, tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseISCSIParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", nil, map[string]string{}, false},
+		{"params", []string{"node.session.cmds_max=256", " node.session.queue_depth = 64 "},
+			map[string]string{"node.session.cmds_max": "256", "node.session.queue_depth": "64"}, false},
+		{"value with equals sign", []string{"node.session.iscsi.FirstBurstLength=262144"},
+			map[string]string{"node.session.iscsi.FirstBurstLength": "262144"}, false},
+		{"missing value", []string{"node.session.cmds_max"}, nil, true},
+		{"reserved", []string{"node.session.auth.username=admin"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseISCSIParams(tt.list)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseISCSIParams(%q) error = %v, want error %v", tt.list, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseISCSIParams(%q) = %v, want %v", tt.list, got, tt.want)
+			}
+		})
+	}
+}
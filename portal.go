@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+// findPortal returns the ID of a portal listening on every configured
+// portal address, creating one when the plugin may manage portals.
+func (d *FreeNASISCSIDriver) findPortal() (int, error) {
+	portals, err := d.freenas.GetISCSIPortalList()
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range portals {
+		listening := map[string]bool{}
+		for _, ip := range p.IPs {
+			listening[ip] = true
+		}
+		found := true
+		for _, ip := range d.opts.PortalIPs {
+			if !listening[ip] {
+				found = false
+				break
+			}
+		}
+		if found {
+			return p.ID, nil
+		}
+	}
+	if !d.opts.ManagePortal {
+		return 0, fmt.Errorf("no iSCSI portal listens on %s and FREENAS_MANAGE_PORTAL is false", strings.Join(d.opts.PortalIPs, ", "))
+	}
+	p, err := d.freenas.CreateISCSIPortal(d.opts.PortalIPs)
+	if err != nil {
+		return 0, err
+	}
+	return p.ID, nil
+}
+
+// findTarget returns the IQN of the volume's target and the by-path device
+// of its LUN on each portal to log in through. When the target basename is known the
+// IQN is computed and the node records are created directly; otherwise, or
+// when that fails, the target is discovered through the storage addresses.
+// Without multipath only the first address that works is used.
+func (d *FreeNASISCSIDriver) findTarget(v *FreeNASISCSIVolume) (iqn string, diskpaths []string, err error) {
+	if d.targetBasename != "" {
+		iqn = d.targetBasename + ":" + v.targetName()
+		if diskpaths, err = d.createNodes(iqn, v.LunID); err == nil {
+			return iqn, diskpaths, nil
+		}
+		log.WithField("volume", v.Name).Warnf("falling back to discovery: %s", err)
+	}
+	iqn, diskpaths = "", nil
+	for _, address := range d.opts.StorageAddresses {
+		found, paths, derr := utils.DiscoverISCSITarget(address, v.targetName(), v.LunID)
+		if derr != nil {
+			log.WithField("address", address).Warnf("discovery of %s failed: %s", v.targetName(), derr)
+			err = derr
+			continue
+		}
+		iqn = found
+		for _, p := range paths {
+			if !containsString(diskpaths, p) {
+				diskpaths = append(diskpaths, p)
+			}
+		}
+		if !d.opts.Multipath {
+			break
+		}
+	}
+	if iqn == "" {
+		return "", nil, err
+	}
+	return iqn, diskpaths, nil
+}
+
+// createNodes creates the node records of the target on the storage
+// addresses and returns the by-path devices LUN lun will show up as.
+func (d *FreeNASISCSIDriver) createNodes(iqn string, lun int) (diskpaths []string, err error) {
+	addresses := d.opts.StorageAddresses
+	if !d.opts.Multipath {
+		addresses = addresses[:1]
+	}
+	for _, address := range addresses {
+		portal, err := utils.ISCSIPortal(address)
+		if err != nil {
+			return nil, err
+		}
+		if err := utils.CreateISCSINode(iqn, portal); err != nil {
+			return nil, err
+		}
+		diskpaths = append(diskpaths, utils.ISCSIDiskPath(portal, iqn, lun))
+	}
+	return diskpaths, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// shareHost is the host part of the first storage address, bracketed if it
+// is an IPv6 address, for use in NFS and SMB mount sources.
+func (d *FreeNASISCSIDriver) shareHost() string {
+	host := d.opts.StorageAddresses[0]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
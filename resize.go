@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+const resizeTimeout = 30 * time.Second
+
+// growPendingProperty is the ZFS user property marking a zvol whose
+// filesystem was not grown since it was resized, so in global scope the
+// host that mounts it next grows it.
+const growPendingProperty = "docker-volume-freenas:grow-pending"
+
+// Resize grows the zvol backing the volume, or the quota of a share volume,
+// to size GiB. When a zvol is attached to this host the iSCSI session is
+// rescanned and the mounted filesystem is grown online; otherwise the
+// filesystem is grown on the next mount. A zvol attached to another host
+// must be resized there, since only that host can grow its filesystem.
+func (d *FreeNASISCSIDriver) Resize(name string, size int) error {
+	log.WithField("method", "resize").Debugf("%s %d", name, size)
+
+	d.Lock()
+	defer d.Unlock()
+
+	v, err := d.findVolume(name)
+	if err != nil {
+		return err
+	}
+	if v.ReadOnly {
+		return fmt.Errorf("volume %s is read-only", name)
+	}
+	if size <= v.Size {
+		return fmt.Errorf("new size %dG must be larger than current size %dG", size, v.Size)
+	}
+	if !v.isBlock() {
+		// a share only needs a larger quota
+		if _, err := d.freenas.UpdateZFSDataset(v.PoolName, v.Name, size, v.Reservation); err != nil {
+			return err
+		}
+		v.Size = size
+		d.saveState()
+		return nil
+	}
+	if d.opts.Scope == scopeGlobal && v.connections == 0 {
+		attached, err := d.volumeAttached(v)
+		if err != nil {
+			return err
+		}
+		if attached {
+			return fmt.Errorf("volume %s is attached to another host, resize it there", name)
+		}
+	}
+	if _, err := d.freenas.UpdateZFSVolume(v.PoolName, v.Name, size); err != nil {
+		return err
+	}
+	v.Size = size
+	d.setGrowPending(v, true)
+	d.saveState()
+
+	if v.connections == 0 || v.diskpath == "" {
+		log.WithField("volume", name).Info("volume is not attached, filesystem will be grown on next mount")
+		return nil
+	}
+	if err := utils.RescanISCSISession(); err != nil {
+		return err
+	}
+	want := int64(size) * 1024 * 1024 * 1024
+	deadline := time.Now().Add(resizeTimeout)
+	for {
+		if d.opts.Multipath {
+			// the map only grows once its paths report the new size
+			if err := utils.ResizeMultipath(v.blockpath); err != nil {
+				log.WithField("volume", name).Debug(err)
+			}
+		}
+		devsize, err := utils.GetBlkDevSize(v.blockpath)
+		if err != nil {
+			return err
+		}
+		if devsize >= want {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s still reports %d bytes after rescan, expected %d", v.blockpath, devsize, want)
+		}
+		time.Sleep(time.Second)
+	}
+	if v.Encrypt == encryptLUKS {
+		if err := utils.LUKSResize(luksName(v)); err != nil {
+			return err
+		}
+	}
+	if err := utils.GrowFS(v.diskpath, v.Mountpoint); err != nil {
+		return err
+	}
+	d.setGrowPending(v, false)
+	d.saveState()
+	return nil
+}
+
+// setGrowPending records whether the filesystem of v must be grown on the
+// next mount, in global scope also on its zvol.
+func (d *FreeNASISCSIDriver) setGrowPending(v *FreeNASISCSIVolume, pending bool) {
+	v.GrowPending = pending
+	if d.opts.Scope != scopeGlobal {
+		return
+	}
+	if err := d.freenas.SetZFSDatasetUserProperty(v.dataset(), growPendingProperty, strconv.FormatBool(pending)); err != nil {
+		log.WithField("volume", v.Name).Errorf("failed to set %s: %s", growPendingProperty, err)
+	}
+}
+
+// growPending reports whether the filesystem of v must be grown, which in
+// global scope another host may have asked for by resizing the volume.
+func (d *FreeNASISCSIDriver) growPending(v *FreeNASISCSIVolume) bool {
+	if v.GrowPending || d.opts.Scope != scopeGlobal {
+		return v.GrowPending
+	}
+	value, err := d.freenas.GetZFSDatasetUserProperty(v.dataset(), growPendingProperty)
+	if err != nil {
+		log.WithField("volume", v.Name).Warnf("failed to read %s: %s", growPendingProperty, err)
+		return false
+	}
+	return value == "true"
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const autoSnapshotPrefix = "auto-"
+const autoSnapshotFormat = "20060102-150405"
+
+// snapshotPeriod converts a snapshot_schedule option to the interval
+// between scheduled snapshots.
+func snapshotPeriod(schedule string) (time.Duration, error) {
+	switch schedule {
+	case "hourly":
+		return time.Hour, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	case "weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+	period, err := time.ParseDuration(schedule)
+	if err != nil || period < time.Minute {
+		return 0, fmt.Errorf("invalid snapshot_schedule %q, use hourly, daily, weekly or a duration of at least 1m", schedule)
+	}
+	return period, nil
+}
+
+// scheduledSnapshot is a snapshot the scheduler found due. It is taken
+// without the driver lock, so it carries what it needs of the volume.
+type scheduledSnapshot struct {
+	name string
+	v    *FreeNASISCSIVolume
+	keep int
+	// mountpoint is frozen for the snapshot, empty when the volume is not
+	// mounted on this host. attachment tells whether it was unmounted
+	// meanwhile.
+	mountpoint string
+	attachment int
+	time       time.Time
+	taken      bool
+}
+
+// runSnapshotScheduler takes the scheduled snapshots of every volume with a
+// snapshot policy and prunes the ones beyond its retention. The due
+// volumes are collected under the driver lock, but the snapshots are taken
+// without it, so a slow FreeNAS or a long freeze does not hold up the
+// other requests. It never returns.
+func (d *FreeNASISCSIDriver) runSnapshotScheduler(interval time.Duration) {
+	for range time.Tick(interval) {
+		d.RLock()
+		due := d.dueSnapshots()
+		origins := d.origins()
+		d.RUnlock()
+		for _, s := range due {
+			d.takeScheduledSnapshot(s, origins)
+		}
+		d.Lock()
+		for _, s := range due {
+			// a volume removed meanwhile has nothing left to record
+			if s.taken && d.volumes[s.name] == s.v {
+				s.v.LastSnapshot = s.time
+			}
+		}
+		d.saveState()
+		d.Unlock()
+	}
+}
+
+// dueSnapshots returns the volumes whose scheduled snapshot is due.
+func (d *FreeNASISCSIDriver) dueSnapshots() []*scheduledSnapshot {
+	var due []*scheduledSnapshot
+	for name, v := range d.volumes {
+		if v.SnapshotSchedule == "" {
+			continue
+		}
+		if v.SnapshotHost != "" && v.SnapshotHost != d.initiatorName {
+			// in global scope every host that discovered the volume
+			// knows its policy, but only the one that created it runs it
+			continue
+		}
+		period, err := snapshotPeriod(v.SnapshotSchedule)
+		if err != nil {
+			log.WithField("volume", name).Error(err)
+			continue
+		}
+		if time.Since(v.LastSnapshot) < period {
+			continue
+		}
+		due = append(due, &scheduledSnapshot{
+			name:       name,
+			v:          v,
+			keep:       v.SnapshotKeep,
+			mountpoint: freezeMountpoint(v),
+			attachment: v.attachment,
+			time:       time.Now().UTC(),
+		})
+	}
+	return due
+}
+
+// takeScheduledSnapshot takes a due snapshot and prunes the scheduled
+// snapshots of the volume. While a filesystem is frozen it holds
+// sessionLock, so the volume cannot be unmounted underneath the freeze.
+func (d *FreeNASISCSIDriver) takeScheduledSnapshot(s *scheduledSnapshot, origins map[string]bool) {
+	snap := autoSnapshotPrefix + s.time.Format(autoSnapshotFormat)
+	var err error
+	if s.mountpoint == "" {
+		_, err = d.snapshotDataset(s.v.dataset(), "", snap)
+	} else {
+		d.sessionLock.Lock()
+		if s.v.attachment != s.attachment {
+			// unmounted or mounted again, the next round takes it
+			d.sessionLock.Unlock()
+			return
+		}
+		_, err = d.snapshotDataset(s.v.dataset(), s.mountpoint, snap)
+		d.sessionLock.Unlock()
+	}
+	if err != nil {
+		log.WithField("volume", s.name).Errorf("scheduled snapshot failed: %s", err)
+		return
+	}
+	s.taken = true
+	if err := d.pruneSnapshots(s.v, s.keep, origins); err != nil {
+		log.WithField("volume", s.name).Errorf("failed to prune snapshots: %s", err)
+	}
+}
+
+// pruneSnapshots deletes the oldest scheduled snapshots of the volume until
+// at most keep are left. Snapshots in origins, those a clone was made from,
+// are kept. A keep of 0 keeps every snapshot.
+func (d *FreeNASISCSIDriver) pruneSnapshots(v *FreeNASISCSIVolume, keep int, origins map[string]bool) error {
+	if keep <= 0 {
+		return nil
+	}
+	snaps, err := d.snapshots(v)
+	if err != nil {
+		return err
+	}
+	var auto []string
+	for _, s := range snaps {
+		if strings.HasPrefix(s.Name, autoSnapshotPrefix) {
+			auto = append(auto, s.FullName)
+		}
+	}
+	// the timestamp in the name sorts oldest first
+	sort.Strings(auto)
+	for i := 0; i < len(auto)-keep; i++ {
+		if origins[auto[i]] {
+			continue
+		}
+		if err := d.freenas.DeleteZFSSnapshot(auto[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSnapshots deletes every snapshot of the volume's zvol.
+func (d *FreeNASISCSIDriver) removeSnapshots(v *FreeNASISCSIVolume) {
+	snaps, err := d.snapshots(v)
+	if err != nil {
+		log.WithField("volume", v.Name).Error(err)
+		return
+	}
+	for _, s := range snaps {
+		if err := d.freenas.DeleteZFSSnapshot(s.FullName); err != nil {
+			log.WithField("snapshot", s.FullName).Error(err)
+		}
+	}
+}
+
+// origins returns the snapshots volumes were cloned from.
+func (d *FreeNASISCSIDriver) origins() map[string]bool {
+	origins := map[string]bool{}
+	for _, v := range d.volumes {
+		if v.Origin != "" {
+			origins[v.Origin] = true
+		}
+	}
+	return origins
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotPeriod(t *testing.T) {
+	tests := []struct {
+		schedule string
+		want     time.Duration
+		wantErr  bool
+	}{
+		{"hourly", time.Hour, false},
+		{"daily", 24 * time.Hour, false},
+		{"weekly", 7 * 24 * time.Hour, false},
+		{"15m", 15 * time.Minute, false},
+		{"1m", time.Minute, false},
+		{"30s", 0, true},
+		{"monthly", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schedule, func(t *testing.T) {
+			got, err := snapshotPeriod(tt.schedule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("snapshotPeriod(%q) error = %v, want error %v", tt.schedule, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("snapshotPeriod(%q) = %s, want %s", tt.schedule, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const (
+	scopeLocal  = "local"
+	scopeGlobal = "global"
+)
+
+const volumePrefix = "docker-"
+
+// volumeOptionsProperty is the ZFS user property holding the options a
+// volume was created with, which FreeNAS has no other place for.
+const volumeOptionsProperty = "docker-volume-freenas:options"
+
+// volumeOptions are the create options of a volume that other hosts cannot
+// derive from its zvol, dataset, iSCSI objects or share.
+type volumeOptions struct {
+	ForceTakeover    bool              `json:"force_takeover,omitempty"`
+	FSCheck          string            `json:"fsck,omitempty"`
+	AllowFormat      bool              `json:"allow_format,omitempty"`
+	Encrypt          string            `json:"encrypt,omitempty"`
+	LUKSKeyFile      string            `json:"luks_key_file,omitempty"`
+	ZFSEncryption    string            `json:"zfs_encryption,omitempty"`
+	ZFSKeyFormat     string            `json:"zfs_key_format,omitempty"`
+	ISCSIParams      map[string]string `json:"iscsi,omitempty"`
+	SnapshotSchedule string            `json:"snapshot_schedule,omitempty"`
+	SnapshotKeep     int               `json:"snapshot_keep,omitempty"`
+	SnapshotHost     string            `json:"snapshot_host,omitempty"`
+	Reservation      bool              `json:"reservation,omitempty"`
+	NFSVersion       string            `json:"nfs_version,omitempty"`
+	UID              string            `json:"uid,omitempty"`
+	GID              string            `json:"gid,omitempty"`
+	FileMode         string            `json:"file_mode,omitempty"`
+	DirMode          string            `json:"dir_mode,omitempty"`
+}
+
+// saveOptions stores the create options of v on its dataset in global
+// scope, where other hosts discover the volume.
+func (d *FreeNASISCSIDriver) saveOptions(v *FreeNASISCSIVolume) error {
+	if d.opts.Scope != scopeGlobal {
+		return nil
+	}
+	data, err := json.Marshal(volumeOptions{
+		ForceTakeover:    v.ForceTakeover,
+		FSCheck:          v.FSCheck,
+		AllowFormat:      v.AllowFormat,
+		Encrypt:          v.Encrypt,
+		LUKSKeyFile:      v.LUKSKeyFile,
+		ZFSEncryption:    v.ZFSEncryption,
+		ZFSKeyFormat:     v.ZFSKeyFormat,
+		ISCSIParams:      v.ISCSIParams,
+		SnapshotSchedule: v.SnapshotSchedule,
+		SnapshotKeep:     v.SnapshotKeep,
+		SnapshotHost:     v.SnapshotHost,
+		Reservation:      v.Reservation,
+		NFSVersion:       v.NFSVersion,
+		UID:              v.UID,
+		GID:              v.GID,
+		FileMode:         v.FileMode,
+		DirMode:          v.DirMode,
+	})
+	if err != nil {
+		return err
+	}
+	return d.freenas.SetZFSDatasetUserProperty(v.dataset(), volumeOptionsProperty, string(data))
+}
+
+// loadOptions restores the create options saved with saveOptions. Volumes
+// created before the options were saved keep the defaults.
+func (d *FreeNASISCSIDriver) loadOptions(v *FreeNASISCSIVolume) error {
+	data, err := d.freenas.GetZFSDatasetUserProperty(v.dataset(), volumeOptionsProperty)
+	if err != nil || data == "" {
+		return err
+	}
+	var o volumeOptions
+	if err := json.Unmarshal([]byte(data), &o); err != nil {
+		return fmt.Errorf("invalid %s property: %s", volumeOptionsProperty, err)
+	}
+	v.ForceTakeover = o.ForceTakeover
+	v.FSCheck = o.FSCheck
+	v.AllowFormat = o.AllowFormat
+	v.Encrypt = o.Encrypt
+	v.LUKSKeyFile = o.LUKSKeyFile
+	v.ZFSEncryption = o.ZFSEncryption
+	v.ZFSKeyFormat = o.ZFSKeyFormat
+	v.ISCSIParams = o.ISCSIParams
+	v.SnapshotSchedule = o.SnapshotSchedule
+	v.SnapshotKeep = o.SnapshotKeep
+	v.SnapshotHost = o.SnapshotHost
+	v.Reservation = o.Reservation
+	v.NFSVersion = o.NFSVersion
+	v.UID = o.UID
+	v.GID = o.GID
+	v.FileMode = o.FileMode
+	v.DirMode = o.DirMode
+	return nil
+}
+
+// findVolume returns the volume called name. In global scope volumes created
+// by other hosts are looked up on FreeNAS and added to the local state.
+func (d *FreeNASISCSIDriver) findVolume(name string) (*FreeNASISCSIVolume, error) {
+	if v, ok := d.volumes[name]; ok {
+		return v, nil
+	}
+	if d.opts.Scope != scopeGlobal {
+		return nil, errors.New("volume not found")
+	}
+	v, err := d.discoverVolume(name)
+	if err != nil {
+		return nil, err
+	}
+	d.volumes[name] = v
+	d.saveState()
+	return v, nil
+}
+
+// remoteVolumes returns the names of the docker volumes found on FreeNAS.
+func (d *FreeNASISCSIDriver) remoteVolumes() (map[string]bool, error) {
+	pools, err := d.freenas.GetVolumeList()
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, pool := range pools {
+		zvols, err := d.freenas.GetZFSVolumeList(pool.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, zvol := range zvols {
+			if n := path.Base(zvol.Name); strings.HasPrefix(n, volumePrefix) {
+				names[strings.TrimPrefix(n, volumePrefix)] = true
+			}
+		}
+		datasets, err := d.freenas.GetZFSDatasetList(pool.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ds := range datasets {
+			if n := path.Base(ds.Name); strings.HasPrefix(n, volumePrefix) {
+				names[strings.TrimPrefix(n, volumePrefix)] = true
+			}
+		}
+	}
+	return names, nil
+}
+
+// discoverVolume rebuilds the state of a volume created by another host from
+// the zvol or dataset and its iSCSI objects or share on FreeNAS.
+func (d *FreeNASISCSIDriver) discoverVolume(name string) (*FreeNASISCSIVolume, error) {
+	v := &FreeNASISCSIVolume{
+		Name:       volumePrefix + name,
+		Mountpoint: filepath.Join(d.root, name),
+	}
+	pools, err := d.freenas.GetVolumeList()
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		zvols, err := d.freenas.GetZFSVolumeList(pool.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, zvol := range zvols {
+			if path.Base(zvol.Name) == v.Name {
+				v.Type = volumeTypeISCSI
+				v.PoolName = pool.Name
+				v.Size = zvol.VolSize / (1024 * 1024 * 1024)
+				d.discoverOptions(v)
+				d.discoverOrigin(v)
+				return v, d.discoverISCSIObjects(v)
+			}
+		}
+		datasets, err := d.freenas.GetZFSDatasetList(pool.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ds := range datasets {
+			if path.Base(ds.Name) == v.Name {
+				v.PoolName = pool.Name
+				d.discoverOptions(v)
+				d.discoverOrigin(v)
+				return v, d.discoverShare(v)
+			}
+		}
+	}
+	return nil, errors.New("volume not found")
+}
+
+// discoverOptions loads the create options of a discovered volume. A volume
+// whose options cannot be read is still usable with the defaults.
+func (d *FreeNASISCSIDriver) discoverOptions(v *FreeNASISCSIVolume) {
+	if err := d.loadOptions(v); err != nil {
+		log.WithField("volume", v.Name).Warnf("failed to load volume options: %s", err)
+	}
+}
+
+// discoverOrigin finds the snapshot a discovered volume was cloned from, so
+// every host knows the clones of a volume. The temporary snapshots of
+// clones are recognized by their name.
+func (d *FreeNASISCSIDriver) discoverOrigin(v *FreeNASISCSIVolume) {
+	origin, err := d.freenas.GetZFSDatasetOrigin(v.dataset())
+	if err != nil {
+		log.WithField("volume", v.Name).Warnf("failed to read the origin: %s", err)
+		return
+	}
+	v.Origin = origin
+	if i := strings.Index(origin, "@"); i >= 0 {
+		v.TemporarySnapshot = strings.HasPrefix(origin[i+1:], cloneSnapshotPrefix)
+	}
+}
+
+// discoverRemoteVolumes adds the volumes on FreeNAS that are missing from
+// the local state, so the clones other hosts made of a volume are known
+// before it is removed.
+func (d *FreeNASISCSIDriver) discoverRemoteVolumes() error {
+	names, err := d.remoteVolumes()
+	if err != nil {
+		return err
+	}
+	for name := range names {
+		if _, ok := d.volumes[name]; ok {
+			continue
+		}
+		if _, err := d.findVolume(name); err != nil {
+			log.WithField("volume", name).Warnf("failed to discover volume: %s", err)
+		}
+	}
+	return nil
+}
+
+// discoverISCSIObjects finds the volume's extent and follows its mapping to
+// the target, which is a shared one when it is not named after the volume.
+func (d *FreeNASISCSIDriver) discoverISCSIObjects(v *FreeNASISCSIVolume) error {
+	extents, err := d.freenas.GetISCSIExtentList()
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		if e.Name == v.Name {
+			v.ExtentID = e.ID
+			v.ReadOnly = e.ReadOnly
+		}
+	}
+	mappings, err := d.freenas.GetISCSITargetToExtentList()
+	if err != nil {
+		return err
+	}
+	for _, m := range mappings {
+		if v.ExtentID != 0 && m.ExtentID == v.ExtentID {
+			v.TargetToExtentID = m.ID
+			v.TargetID = m.TargetID
+			v.LunID = m.LunID
+		}
+	}
+	if v.TargetID == 0 || v.ExtentID == 0 {
+		return fmt.Errorf("iSCSI target or extent of %s not found", v.Name)
+	}
+	targets, err := d.freenas.GetISCSITargetList()
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		if t.ID == v.TargetID && t.Name != v.Name {
+			v.TargetName = t.Name
+		}
+	}
+	tgroups, err := d.freenas.GetISCSITargetGroupList()
+	if err != nil {
+		return err
+	}
+	for _, tg := range tgroups {
+		if tg.TargetID == v.TargetID {
+			if v.TargetName == "" {
+				v.TargetGroupID = tg.ID
+			}
+			if tg.AuthType != "None" {
+				v.AuthType = tg.AuthType
+			}
+		}
+	}
+	return nil
+}
+
+func (d *FreeNASISCSIDriver) discoverShare(v *FreeNASISCSIVolume) error {
+	nfsShares, err := d.freenas.GetNFSShareList()
+	if err != nil {
+		return err
+	}
+	for _, s := range nfsShares {
+		for _, p := range s.Paths {
+			if p == v.sharePath() {
+				v.Type, v.ShareID = volumeTypeNFS, s.ID
+				return nil
+			}
+		}
+	}
+	smbShares, err := d.freenas.GetSMBShareList()
+	if err != nil {
+		return err
+	}
+	for _, s := range smbShares {
+		if s.Path == v.sharePath() {
+			v.Type, v.ShareID = volumeTypeSMB, s.ID
+			return nil
+		}
+	}
+	return fmt.Errorf("share of %s not found", v.Name)
+}
+
+// listGlobal lists the volumes on FreeNAS and forgets volumes in the local
+// state that were removed by another host.
+func (d *FreeNASISCSIDriver) listGlobal() ([]*volume.Volume, error) {
+	names, err := d.remoteVolumes()
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range d.volumes {
+		if !names[name] && v.connections == 0 {
+			log.WithField("volume", name).Info("volume was removed by another host")
+			delete(d.volumes, name)
+			d.saveState()
+		}
+	}
+	var vols []*volume.Volume
+	for name := range names {
+		vols = append(vols, &volume.Volume{Name: name, Mountpoint: filepath.Join(d.root, name)})
+	}
+	return vols, nil
+}
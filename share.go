@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	volumeTypeISCSI = "iscsi"
+	volumeTypeNFS   = "nfs"
+	volumeTypeSMB   = "smb"
+)
+
+// isBlock reports whether the volume is a zvol exported over iSCSI, as
+// opposed to a dataset exported as a network share. Volumes created before
+// volume types existed have an empty Type.
+func (v *FreeNASISCSIVolume) isBlock() bool {
+	return v.Type == "" || v.Type == volumeTypeISCSI
+}
+
+// sharePath is the path of the volume's dataset on FreeNAS.
+func (v *FreeNASISCSIVolume) sharePath() string {
+	return "/mnt/" + v.dataset()
+}
+
+// exportShare shares the volume's dataset with the configured networks.
+func (d *FreeNASISCSIDriver) exportShare(v *FreeNASISCSIVolume) error {
+	switch v.Type {
+	case volumeTypeNFS:
+		if len(d.opts.NFSNetworks) == 0 {
+			return errors.New("FREENAS_NFS_NETWORKS must be set to create nfs volumes")
+		}
+		share, err := d.freenas.CreateNFSShare(v.sharePath(), d.opts.NFSNetworks, "docker volume "+v.Name, v.ReadOnly)
+		if err != nil {
+			return err
+		}
+		v.ShareID = share.ID
+		return nil
+	case volumeTypeSMB:
+		share, err := d.freenas.CreateSMBShare(v.Name, v.sharePath(), "docker volume "+v.Name, v.ReadOnly)
+		if err != nil {
+			return err
+		}
+		v.ShareID = share.ID
+		return nil
+	}
+	return fmt.Errorf("unknown volume type %q", v.Type)
+}
+
+func (d *FreeNASISCSIDriver) unexportShare(v *FreeNASISCSIVolume) error {
+	switch v.Type {
+	case volumeTypeNFS:
+		return d.freenas.DeleteNFSShare(v.ShareID)
+	case volumeTypeSMB:
+		return d.freenas.DeleteSMBShare(v.ShareID)
+	}
+	return fmt.Errorf("unknown volume type %q", v.Type)
+}
+
+func (d *FreeNASISCSIDriver) mountShare(v *FreeNASISCSIVolume) error {
+	var cmd *exec.Cmd
+	switch v.Type {
+	case volumeTypeNFS:
+		version := v.NFSVersion
+		if version == "" {
+			version = d.opts.NFSVersion
+		}
+		source := fmt.Sprintf("%s:%s", d.shareHost(), v.sharePath())
+		opts := "vers=" + version
+		if v.ReadOnly {
+			opts += ",ro"
+		}
+		cmd = exec.Command("mount", "-t", "nfs", "-o", opts, source, v.Mountpoint)
+	case volumeTypeSMB:
+		opts := []string{"credentials=" + d.opts.SMBCredentials}
+		if v.ReadOnly {
+			opts = append(opts, "ro")
+		}
+		if v.UID != "" {
+			opts = append(opts, "uid="+v.UID)
+		}
+		if v.GID != "" {
+			opts = append(opts, "gid="+v.GID)
+		}
+		if v.FileMode != "" {
+			opts = append(opts, "file_mode="+v.FileMode)
+		}
+		if v.DirMode != "" {
+			opts = append(opts, "dir_mode="+v.DirMode)
+		}
+		source := fmt.Sprintf("//%s/%s", d.shareHost(), v.Name)
+		cmd = exec.Command("mount", "-t", "cifs", "-o", strings.Join(opts, ","), source, v.Mountpoint)
+	default:
+		return fmt.Errorf("unknown volume type %q", v.Type)
+	}
+	log.WithField("volume", v.Name).Debug(strings.Join(cmd.Args, " "))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+var modeRegexp = regexp.MustCompile(`^0?[0-7]{3,4}$`)
+
+// parseShareOption stores the mount options of smb volumes.
+func (v *FreeNASISCSIVolume) parseShareOption(key, val string) error {
+	switch key {
+	case "uid", "gid":
+		if _, err := strconv.ParseUint(val, 10, 32); err != nil {
+			return fmt.Errorf("Invalid %s value", key)
+		}
+		if key == "uid" {
+			v.UID = val
+		} else {
+			v.GID = val
+		}
+	case "file_mode", "dir_mode":
+		if !modeRegexp.MatchString(val) {
+			return fmt.Errorf("Invalid %s value", key)
+		}
+		if key == "file_mode" {
+			v.FileMode = val
+		} else {
+			v.DirMode = val
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daneshih1125/docker-volume-freenas/freenas"
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+// dataset returns the ZFS name of the zvol backing the volume.
+func (v *FreeNASISCSIVolume) dataset() string {
+	return v.PoolName + "/" + v.Name
+}
+
+func validSnapshotName(snap string) error {
+	if snap == "" || strings.ContainsAny(snap, "@/ ") {
+		return fmt.Errorf("invalid snapshot name %q", snap)
+	}
+	return nil
+}
+
+// volumeAttached reports whether the volume is mounted on this host, was
+// left attached to it by a crash, or any initiator is logged in to its
+// target on FreeNAS. Clients of share volumes on other hosts are not
+// visible through the API. A LUN of a shared target is attached while a
+// host holds its owner marker, which is only kept with Fencing. Without
+// Fencing the sessions may not be listed either, on FreeNAS releases
+// without the 2.0 API, in which case only this host is checked.
+func (d *FreeNASISCSIDriver) volumeAttached(v *FreeNASISCSIVolume) (bool, error) {
+	if v.connections > 0 || v.Attached {
+		return true, nil
+	}
+	if !v.isBlock() {
+		return false, nil
+	}
+	if v.TargetName != "" {
+		if !d.opts.Fencing {
+			return false, nil
+		}
+		comments, err := d.freenas.GetZFSDatasetComments(v.dataset())
+		if err != nil {
+			return false, err
+		}
+		return parseOwnerMarker(comments).Owner != "", nil
+	}
+	sessions, err := d.freenas.GetISCSISessionList()
+	if err != nil {
+		if !d.opts.Fencing {
+			log.WithField("volume", v.Name).Warnf("failed to list iSCSI sessions, only this host is checked: %s", err)
+			return false, nil
+		}
+		return false, err
+	}
+	for _, s := range sessions {
+		if strings.HasSuffix(s.Target, ":"+v.Name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// snapshots returns the snapshots of the volume's zvol.
+func (d *FreeNASISCSIDriver) snapshots(v *FreeNASISCSIVolume) ([]freenas.ZFSSnapshot, error) {
+	all, err := d.freenas.GetZFSSnapshotList()
+	if err != nil {
+		return nil, err
+	}
+	var snaps []freenas.ZFSSnapshot
+	for _, s := range all {
+		if s.Filesystem == v.dataset() {
+			snaps = append(snaps, s)
+		}
+	}
+	return snaps, nil
+}
+
+// snapshotResult describes a snapshot taken by takeSnapshot.
+type snapshotResult struct {
+	Snapshot string
+	// FreezeDuration is how long the mounted filesystem was frozen, empty
+	// when the volume was not mounted on this host.
+	FreezeDuration string `json:",omitempty"`
+}
+
+// takeSnapshot snapshots the volume's zvol. When the volume is mounted on
+// this host its filesystem is frozen for the duration of the snapshot, so
+// the snapshot is filesystem consistent rather than only crash consistent.
+func (d *FreeNASISCSIDriver) takeSnapshot(v *FreeNASISCSIVolume, snap string) (snapshotResult, error) {
+	return d.snapshotDataset(v.dataset(), freezeMountpoint(v), snap)
+}
+
+// freezeMountpoint returns the mountpoint to freeze for a snapshot of the
+// volume, empty when it is not mounted writable on this host.
+func freezeMountpoint(v *FreeNASISCSIVolume) string {
+	if v.connections == 0 || v.diskpath == "" || v.ReadOnly {
+		return ""
+	}
+	return v.Mountpoint
+}
+
+// snapshotDataset snapshots the dataset, freezing the filesystem at
+// mountpoint unless it is empty. The filesystem is always thawed, even when
+// the snapshot call fails or does not finish within FreezeTimeout, in which
+// case the snapshot is deleted should it still complete.
+func (d *FreeNASISCSIDriver) snapshotDataset(dataset, mountpoint, snap string) (res snapshotResult, err error) {
+	res.Snapshot = dataset + "@" + snap
+	if mountpoint == "" {
+		_, err = d.freenas.CreateZFSSnapshot(dataset, snap)
+		return res, err
+	}
+
+	if err := utils.FreezeFS(mountpoint); err != nil {
+		return res, err
+	}
+	start := time.Now()
+	defer func() {
+		if thawErr := utils.ThawFS(mountpoint); thawErr != nil {
+			log.WithField("mountpoint", mountpoint).Errorf("failed to thaw: %s", thawErr)
+			if err == nil {
+				err = thawErr
+			}
+		}
+		frozen := time.Since(start)
+		res.FreezeDuration = frozen.String()
+		log.WithField("snapshot", res.Snapshot).Infof("%s was frozen for %s", mountpoint, frozen)
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.freenas.CreateZFSSnapshot(dataset, snap)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(d.opts.FreezeTimeout):
+		err = fmt.Errorf("snapshot %s did not finish within %s", res.Snapshot, d.opts.FreezeTimeout)
+		// a late snapshot was taken after the thaw and is not consistent;
+		// the request timeout of the API client bounds the wait
+		go func(snapshot string) {
+			if err := <-done; err != nil {
+				return
+			}
+			log.WithField("snapshot", snapshot).Warn("deleting snapshot that finished after the freeze timeout")
+			if err := d.freenas.DeleteZFSSnapshot(snapshot); err != nil {
+				log.WithField("snapshot", snapshot).Error(err)
+			}
+		}(res.Snapshot)
+	}
+	return res, err
+}
+
+func (d *FreeNASISCSIDriver) CreateSnapshot(name, snap string) (snapshotResult, error) {
+	log.WithField("method", "snapshot create").Debugf("%s@%s", name, snap)
+
+	d.Lock()
+	defer d.Unlock()
+
+	v, err := d.findVolume(name)
+	if err != nil {
+		return snapshotResult{}, err
+	}
+	if err := validSnapshotName(snap); err != nil {
+		return snapshotResult{}, err
+	}
+	return d.takeSnapshot(v, snap)
+}
+
+func (d *FreeNASISCSIDriver) ListSnapshots(name string) ([]freenas.ZFSSnapshot, error) {
+	log.WithField("method", "snapshot list").Debug(name)
+
+	d.Lock()
+	defer d.Unlock()
+
+	v, err := d.findVolume(name)
+	if err != nil {
+		return nil, err
+	}
+	return d.snapshots(v)
+}
+
+func (d *FreeNASISCSIDriver) RemoveSnapshot(name, snap string) error {
+	log.WithField("method", "snapshot remove").Debugf("%s@%s", name, snap)
+
+	d.Lock()
+	defer d.Unlock()
+
+	v, err := d.findVolume(name)
+	if err != nil {
+		return err
+	}
+	if err := validSnapshotName(snap); err != nil {
+		return err
+	}
+	return d.freenas.DeleteZFSSnapshot(v.dataset() + "@" + snap)
+}
+
+// RollbackSnapshot reverts the volume to snap, destroying any later
+// snapshots. The volume must not be attached anywhere, since the block
+// device would change under a mounted filesystem.
+func (d *FreeNASISCSIDriver) RollbackSnapshot(name, snap string) error {
+	log.WithField("method", "snapshot rollback").Debugf("%s@%s", name, snap)
+
+	d.Lock()
+	defer d.Unlock()
+
+	v, err := d.findVolume(name)
+	if err != nil {
+		return err
+	}
+	if err := validSnapshotName(snap); err != nil {
+		return err
+	}
+	attached, err := d.volumeAttached(v)
+	if err != nil {
+		return err
+	}
+	if attached {
+		return fmt.Errorf("volume %s is mounted, unmount it on every host before rollback", name)
+	}
+	return d.freenas.RollbackZFSSnapshot(v.dataset() + "@" + snap)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+// volumeStatus is the status reported for the volume by docker volume
+// inspect.
+func (d *FreeNASISCSIDriver) volumeStatus(v *FreeNASISCSIVolume) map[string]interface{} {
+	status := map[string]interface{}{
+		"type":    v.Type,
+		"size":    v.Size,
+		"mounted": v.connections > 0,
+	}
+	if v.ReadOnly {
+		status["readonly"] = true
+	}
+	if v.TargetName != "" {
+		status["target"] = v.TargetName
+		status["lun"] = v.LunID
+	}
+	if params := d.nodeParams(v); v.isBlock() && len(params) != 0 {
+		status["iscsi"] = params
+	}
+	if v.diskpath != "" {
+		status["device"] = v.diskpath
+	}
+	if v.Encrypt != "" {
+		status["encrypt"] = v.Encrypt
+	}
+	if v.ZFSEncryption != "" {
+		status["zfs_encryption"] = strings.ToLower(v.ZFSEncryption)
+	}
+	if !v.FSCheckTime.IsZero() {
+		status["fsck"] = map[string]interface{}{
+			"time":   v.FSCheckTime,
+			"result": v.FSCheckResult,
+		}
+	}
+	if v.sessionError != "" {
+		status["session"] = map[string]interface{}{
+			"state": sessionFailed,
+			"error": v.sessionError,
+			"since": v.sessionSince,
+		}
+	}
+	if v.isBlock() && len(v.paths) != 0 {
+		paths := map[string]string{}
+		for _, p := range v.paths {
+			paths[p] = utils.GetPathState(p)
+		}
+		status["paths"] = paths
+	}
+	return status
+}
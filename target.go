@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+const (
+	layoutVolume = "volume"
+	layoutHost   = "host"
+	layoutGroup  = "group"
+)
+
+// sharedTargetPrefix starts the names of targets shared by several volumes.
+// Docker volume names cannot hold a colon, so a shared target never takes
+// the name of a volume's own target.
+const sharedTargetPrefix = "docker:"
+
+var invalidTargetChars = regexp.MustCompile(`[^-a-z0-9.]+`)
+
+// sharedTarget is the target the volumes of this host or group are mapped
+// to as LUNs.
+type sharedTarget struct {
+	ID       int
+	Name     string
+	AuthType string
+}
+
+// sharedTargetName returns the name of the target shared in the host or
+// group layout.
+func sharedTargetName(opts driverOptions) (string, error) {
+	name := opts.TargetGroup
+	if opts.TargetLayout == layoutHost {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		name = hostname
+	}
+	name = strings.Trim(invalidTargetChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if name == "" {
+		return "", errors.New("cannot name the shared target, set FREENAS_TARGET_GROUP")
+	}
+	return sharedTargetPrefix + name, nil
+}
+
+// ensureSharedTarget finds the shared target, or creates it with its target
+// group. In the host layout the target is restricted like the targets of
+// single volumes; in the group layout every host of the group logs in to it.
+func (d *FreeNASISCSIDriver) ensureSharedTarget(name string) (*sharedTarget, error) {
+	targets, err := d.freenas.GetISCSITargetList()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		if t.Name != name {
+			continue
+		}
+		st := &sharedTarget{ID: t.ID, Name: t.Name}
+		tgroups, err := d.freenas.GetISCSITargetGroupList()
+		if err != nil {
+			return nil, err
+		}
+		for _, tg := range tgroups {
+			if tg.TargetID == t.ID && tg.AuthType != "None" {
+				st.AuthType = tg.AuthType
+			}
+		}
+		return st, nil
+	}
+	target, err := d.freenas.CreateISCSITarget(name)
+	if err != nil {
+		return nil, err
+	}
+	initiatorGroup := d.initiatorGroup
+	if d.opts.TargetLayout == layoutGroup {
+		initiatorGroup = 0
+	}
+	authType := d.opts.CHAP.authType()
+	if _, err := d.freenas.CreateISCSITargetGroup(target.ID, d.freenasPortal, initiatorGroup, d.authGroup, authType); err != nil {
+		return nil, err
+	}
+	log.WithField("target", target.ID).Infof("created shared target %s", name)
+	return &sharedTarget{ID: target.ID, Name: name, AuthType: authType}, nil
+}
+
+// nextLunID returns the lowest LUN ID not mapped on the target.
+func (d *FreeNASISCSIDriver) nextLunID(targetID int) (int, error) {
+	mappings, err := d.freenas.GetISCSITargetToExtentList()
+	if err != nil {
+		return 0, err
+	}
+	used := map[int]bool{}
+	for _, m := range mappings {
+		if m.TargetID == targetID {
+			used[m.LunID] = true
+		}
+	}
+	lun := 0
+	for used[lun] {
+		lun++
+	}
+	return lun, nil
+}
+
+// targetName is the name of the volume's target: the volume name, or the
+// shared target it is a LUN of.
+func (v *FreeNASISCSIVolume) targetName() string {
+	if v.TargetName != "" {
+		return v.TargetName
+	}
+	return v.Name
+}
+
+// loginTarget logs in to the target through every path. When this host is
+// logged in to a shared target already, the sessions are only rescanned so
+// the volume's LUN shows up. It fails with the iscsiadm error when no
+// session could be logged in, e.g. after a CHAP rejection.
+func (d *FreeNASISCSIDriver) loginTarget(iqn string, paths int) error {
+	sessions, err := utils.CountISCSISessions(iqn)
+	if err != nil {
+		return err
+	}
+	if sessions > 0 {
+		if err := utils.RescanISCSITarget(iqn); err != nil {
+			return err
+		}
+	}
+	if sessions >= paths {
+		return nil
+	}
+	lerr := utils.LoginISCSITarget(iqn)
+	if lerr == nil {
+		return nil
+	}
+	// iscsiadm also fails when only some portals could be logged in to,
+	// which still leaves the volume usable over the others
+	if sessions, err = utils.CountISCSISessions(iqn); err != nil {
+		return err
+	}
+	if sessions == 0 {
+		return lerr
+	}
+	log.WithField("target", iqn).Warnf("%d of %d sessions logged in: %s", sessions, paths, lerr)
+	return nil
+}
+
+// logoutTarget detaches the volume's LUN. The target is logged out unless
+// another volume mounted on this host is a LUN of it too; then only the
+// devices of this LUN are removed.
+func (d *FreeNASISCSIDriver) logoutTarget(v *FreeNASISCSIVolume, iqn string, devices []string) error {
+	if v.TargetName == "" {
+		return utils.LogoutISCSITarget(iqn)
+	}
+	for _, dev := range devices {
+		if err := utils.DeleteSCSIDevice(dev); err != nil {
+			return fmt.Errorf("failed to remove %s: %s", dev, err)
+		}
+	}
+	for _, other := range d.volumes {
+		if other != v && other.iqn == iqn {
+			return nil
+		}
+	}
+	return utils.LogoutISCSITarget(iqn)
+}
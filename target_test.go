@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestSharedTargetName(t *testing.T) {
+	tests := []struct {
+		group   string
+		want    string
+		wantErr bool
+	}{
+		{"web", "docker:web", false},
+		{"Web Servers", "docker:web-servers", false},
+		{"db_01.prod", "docker:db-01.prod", false},
+		{"--edge--", "docker:edge", false},
+		{"", "", true},
+		{"!!!", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.group, func(t *testing.T) {
+			got, err := sharedTargetName(driverOptions{TargetLayout: layoutGroup, TargetGroup: tt.group})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sharedTargetName(%q) error = %v, want error %v", tt.group, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("sharedTargetName(%q) = %q, want %q", tt.group, got, tt.want)
+			}
+		})
+	}
+}
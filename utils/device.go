@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// CountISCSISessions returns the number of sessions logged in to the target.
+func CountISCSISessions(iqn string) (count int, err error) {
+	sessions, err := filepath.Glob("/sys/class/iscsi_session/session*")
+	if err != nil {
+		return 0, err
+	}
+	for _, session := range sessions {
+		name, err := ioutil.ReadFile(filepath.Join(session, "targetname"))
+		if err == nil && strings.TrimSpace(string(name)) == iqn {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ISCSISessionStates returns the state of every session logged in to the
+// target by session name, LOGGED_IN for a healthy one.
+func ISCSISessionStates(iqn string) (states map[string]string, err error) {
+	sessions, err := filepath.Glob("/sys/class/iscsi_session/session*")
+	if err != nil {
+		return nil, err
+	}
+	states = map[string]string{}
+	for _, session := range sessions {
+		name, err := ioutil.ReadFile(filepath.Join(session, "targetname"))
+		if err != nil || strings.TrimSpace(string(name)) != iqn {
+			continue
+		}
+		state, err := ioutil.ReadFile(filepath.Join(session, "state"))
+		if err != nil {
+			return nil, err
+		}
+		states[filepath.Base(session)] = strings.TrimSpace(string(state))
+	}
+	return states, nil
+}
+
+// LogoutISCSISession logs out the session named as in ISCSISessionStates.
+func LogoutISCSISession(session string) error {
+	sid := strings.TrimPrefix(session, "session")
+	out, err := exec.Command("iscsiadm", "-m", "session", "-r", sid, "--logout").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to log out %s: %s: %s", session, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// SetPathRunning brings a SCSI device the kernel took offline, after its
+// session was down for longer than the replacement timeout, back online.
+func SetPathRunning(diskpath string) error {
+	dev, err := filepath.EvalSymlinks(diskpath)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join("/sys/block", filepath.Base(dev), "device", "state"), []byte("running"), 0200)
+}
+
+// RescanISCSITarget rescans the sessions of the target, so LUNs mapped
+// after login show up.
+func RescanISCSITarget(iqn string) error {
+	out, err := exec.Command("iscsiadm", "-m", "node", "-T", iqn, "--rescan").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iscsiadm rescan %s: %s: %s", iqn, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// DeleteSCSIDevice removes the SCSI device behind the block device from the
+// kernel, detaching one LUN while the session stays logged in.
+func DeleteSCSIDevice(devpath string) error {
+	dev, err := filepath.EvalSymlinks(devpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join("/sys/block", filepath.Base(dev), "device", "delete"), []byte("1"), 0200)
+}
+
+// FindISCSIDevices returns the block devices of LUN lun of the target in
+// every session logged in to it, resolved through sysfs.
+func FindISCSIDevices(iqn string, lun int) (devices []string, err error) {
+	sessions, err := filepath.Glob("/sys/class/iscsi_session/session*")
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		name, err := ioutil.ReadFile(filepath.Join(session, "targetname"))
+		if err != nil || strings.TrimSpace(string(name)) != iqn {
+			continue
+		}
+		// SCSI devices are named host:channel:target:lun
+		blocks, err := filepath.Glob(filepath.Join(session, "device", "target*", fmt.Sprintf("*:*:*:%d", lun), "block", "*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range blocks {
+			devices = append(devices, "/dev/"+filepath.Base(block))
+		}
+	}
+	return devices, nil
+}
+
+// WaitISCSIDevices waits until count sessions of the target expose LUN lun
+// as a block device whose node exists in /dev, and returns the devices.
+// Instead of sleeping it waits for udev to create the by-path links.
+func WaitISCSIDevices(iqn string, lun, count int, timeout time.Duration) (devices []string, err error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	// by-path only exists once udev has seen the first iSCSI disk
+	watch := "/dev/disk/by-path"
+	if _, err := os.Stat(watch); err != nil {
+		watch = "/dev"
+	}
+	if _, err := unix.InotifyAddWatch(fd, watch, unix.IN_CREATE|unix.IN_MOVED_TO); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 4096)
+	for {
+		devices, err = FindISCSIDevices(iqn, lun)
+		if err != nil {
+			return nil, err
+		}
+		if len(devices) >= count && devicesExist(devices) {
+			return devices, nil
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return nil, fmt.Errorf("LUN %d of %s did not show up within %s, found %d of %d devices", lun, iqn, timeout, len(devices), count)
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, int(remaining/time.Millisecond)+1); err != nil && err != unix.EINTR {
+			return nil, err
+		}
+		// drain the events, only their arrival matters
+		for {
+			if _, err := unix.Read(fd, buf); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func devicesExist(devices []string) bool {
+	for _, dev := range devices {
+		if _, err := os.Stat(dev); err != nil {
+			return false
+		}
+	}
+	return true
+}
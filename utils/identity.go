@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GetLUNSerial returns the SCSI identifier of the LUN behind the device,
+// the NAA ID from VPD page 0x83 as reported by the kernel, e.g.
+// "naa.6589cfc000000f2c...".
+func GetLUNSerial(devpath string) (string, error) {
+	dev, err := filepath.EvalSymlinks(devpath)
+	if err != nil {
+		return "", err
+	}
+	wwid, err := ioutil.ReadFile(filepath.Join("/sys/block", filepath.Base(dev), "device", "wwid"))
+	if err != nil {
+		return "", err
+	}
+	serial := strings.TrimSpace(string(wwid))
+	if serial == "" {
+		return "", fmt.Errorf("%s reports no LUN identifier", devpath)
+	}
+	return serial, nil
+}
+
+// IsBlkDevZeroed reports whether the first MiB of the device only holds
+// zeros.
+func IsBlkDevZeroed(devpath string) (bool, error) {
+	f, err := os.Open(devpath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	buf := make([]byte, 1024*1024)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if n == 0 {
+		return false, errors.New("device is empty")
+	}
+	return bytes.Count(buf[:n], []byte{0}) == n, nil
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Keys are handed to cryptsetup on stdin or through an inherited pipe, so
+// they never show up in the process list or on disk.
+
+func cryptsetup(key []byte, args ...string) error {
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(key)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cryptsetup %s: %s: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// LUKSFormat initializes a LUKS header on the device with key in the first
+// keyslot.
+func LUKSFormat(devpath string, key []byte) error {
+	return cryptsetup(key, "luksFormat", "--batch-mode", "--key-file=-", devpath)
+}
+
+// LUKSOpen opens the LUKS device as /dev/mapper/<name> and returns that
+// path. A mapping that is open already is reused.
+func LUKSOpen(devpath, name string, key []byte, readonly bool) (string, error) {
+	mapper := "/dev/mapper/" + name
+	if _, err := os.Stat(mapper); err == nil {
+		return mapper, nil
+	}
+	args := []string{"open", "--type", "luks", "--key-file=-"}
+	if readonly {
+		args = append(args, "--readonly")
+	}
+	if err := cryptsetup(key, append(args, devpath, name)...); err != nil {
+		return "", err
+	}
+	return mapper, nil
+}
+
+// LUKSClose closes the mapping /dev/mapper/<name>.
+func LUKSClose(name string) error {
+	if _, err := os.Stat("/dev/mapper/" + name); os.IsNotExist(err) {
+		return nil
+	}
+	return cryptsetup(nil, "close", name)
+}
+
+// LUKSResize grows the open mapping to the size of its device.
+func LUKSResize(name string) error {
+	return cryptsetup(nil, "resize", name)
+}
+
+// LUKSAddKey adds newKey to a free keyslot, unlocking the device with key.
+func LUKSAddKey(devpath string, key, newKey []byte) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.Command("cryptsetup", "luksAddKey", "--key-file=-", devpath, "/dev/fd/3")
+	cmd.Stdin = bytes.NewReader(key)
+	cmd.ExtraFiles = []*os.File{r}
+	go func() {
+		w.Write(newKey)
+		w.Close()
+	}()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cryptsetup luksAddKey: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// LUKSRemoveKey wipes the keyslot holding key.
+func LUKSRemoveKey(devpath string, key []byte) error {
+	return cryptsetup(key, "luksRemoveKey", "--key-file=-", devpath)
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Mount mounts the block device source on target with the mount syscall,
+// passing data as the filesystem options. Network filesystems need their
+// mount helpers and are mounted with the mount command instead.
+func Mount(source, target, fstype string, readonly bool, data string) error {
+	var flags uintptr
+	if readonly {
+		flags |= unix.MS_RDONLY
+	}
+	if err := unix.Mount(source, target, fstype, flags, data); err != nil {
+		return &os.PathError{Op: "mount " + source + " on", Path: target, Err: err}
+	}
+	return nil
+}
+
+const (
+	unmountRetries = 5
+	unmountBackoff = time.Second
+)
+
+// Unmount unmounts target, retrying while it is busy. A mount that stays
+// busy is detached lazily, so it disappears with its last user, and an
+// error is returned because the device is still in use.
+func Unmount(target string) error {
+	var err error
+	for i := 0; i < unmountRetries; i++ {
+		err = unix.Unmount(target, 0)
+		switch err {
+		case nil, unix.EINVAL:
+			// EINVAL: target is not mounted
+			return nil
+		case unix.EBUSY:
+			time.Sleep(unmountBackoff)
+			continue
+		}
+		return &os.PathError{Op: "umount", Path: target, Err: err}
+	}
+	if err := unix.Unmount(target, unix.MNT_DETACH); err != nil {
+		return &os.PathError{Op: "umount", Path: target, Err: err}
+	}
+	return fmt.Errorf("umount %s: still busy after %d attempts, detached lazily; the filesystem stays in use until its last user exits", target, unmountRetries)
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WaitMultipathDevice waits until every path device exists and all of them
+// are held by the same device-mapper multipath map, and returns the
+// /dev/mapper device of the map.
+func WaitMultipathDevice(diskpaths []string, timeout time.Duration) (mapper string, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		mapper, err = findMultipathDevice(diskpaths)
+		if err == nil {
+			return mapper, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("multipath device not ready after %s: %s", timeout, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func findMultipathDevice(diskpaths []string) (mapper string, err error) {
+	var holder string
+	for _, diskpath := range diskpaths {
+		dev, err := filepath.EvalSymlinks(diskpath)
+		if err != nil {
+			return "", err
+		}
+		name := filepath.Base(dev)
+		holders, err := ioutil.ReadDir(filepath.Join("/sys/block", name, "holders"))
+		if err != nil {
+			return "", err
+		}
+		if len(holders) != 1 {
+			return "", fmt.Errorf("%s is not part of a multipath map", name)
+		}
+		if holder != "" && holders[0].Name() != holder {
+			return "", fmt.Errorf("%s belongs to %s, not %s", name, holders[0].Name(), holder)
+		}
+		holder = holders[0].Name()
+	}
+	dmName, err := ioutil.ReadFile(filepath.Join("/sys/block", holder, "dm", "name"))
+	if err != nil {
+		return "", err
+	}
+	return "/dev/mapper/" + strings.TrimSpace(string(dmName)), nil
+}
+
+// GetPathState returns the SCSI device state of a path, "running" when it
+// is healthy and "missing" when the device is gone.
+func GetPathState(diskpath string) string {
+	dev, err := filepath.EvalSymlinks(diskpath)
+	if err != nil {
+		return "missing"
+	}
+	state, err := ioutil.ReadFile(filepath.Join("/sys/block", filepath.Base(dev), "device", "state"))
+	if err != nil {
+		return "missing"
+	}
+	return strings.TrimSpace(string(state))
+}
+
+// FlushMultipath removes the multipath map after its device was unmounted.
+func FlushMultipath(mapper string) error {
+	out, err := exec.Command("multipath", "-f", filepath.Base(mapper)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("multipath -f: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ResizeMultipath makes the multipath map pick up the new size of its
+// paths after a rescan.
+func ResizeMultipath(mapper string) error {
+	out, err := exec.Command("multipathd", "resize", "map", filepath.Base(mapper)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("multipathd resize: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
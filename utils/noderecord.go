@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// iscsiNodeDirs are where open-iscsi keeps its node records, depending on
+// the distribution.
+var iscsiNodeDirs = []string{"/etc/iscsi/nodes", "/var/lib/iscsi/nodes"}
+
+// SetISCSINodeSecrets writes parameters to the node records of the target
+// directly, without passing them to iscsiadm, whose arguments every user
+// on the host can read. The records must exist already.
+func SetISCSINodeSecrets(iqn string, params map[string]string) error {
+	var records []string
+	for _, dir := range iscsiNodeDirs {
+		portals, err := filepath.Glob(filepath.Join(dir, iqn, "*"))
+		if err != nil {
+			return err
+		}
+		for _, portal := range portals {
+			fi, err := os.Stat(portal)
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				// old layout, the portal is the record
+				records = append(records, portal)
+				continue
+			}
+			// one record per iface in the portal directory
+			ifaces, err := filepath.Glob(filepath.Join(portal, "*"))
+			if err != nil {
+				return err
+			}
+			records = append(records, ifaces...)
+		}
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no node record found for %s", iqn)
+	}
+	for _, record := range records {
+		if err := updateNodeRecord(record, params); err != nil {
+			return fmt.Errorf("failed to update node record %s: %s", record, err)
+		}
+	}
+	return nil
+}
+
+// updateNodeRecord sets the "name = value" lines of params in the record,
+// replacing it atomically with a file only readable by root.
+func updateNodeRecord(record string, params map[string]string) error {
+	data, err := ioutil.ReadFile(record)
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		name := strings.TrimSpace(strings.SplitN(line, "=", 2)[0])
+		if value, ok := params[name]; ok {
+			line = name + " = " + value
+			set[name] = true
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	var missing []string
+	for name := range params {
+		if !set[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	end := len(lines)
+	if end > 0 && strings.HasPrefix(lines[end-1], "# END RECORD") {
+		end--
+	}
+	added := make([]string, 0, len(missing))
+	for _, name := range missing {
+		added = append(added, name+" = "+params[name])
+	}
+	lines = append(lines[:end], append(added, lines[end:]...)...)
+	tmp, err := ioutil.TempFile(filepath.Dir(record), "."+filepath.Base(record))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), record)
+}
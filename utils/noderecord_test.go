@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateNodeRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "noderecord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name   string
+		record string
+		want   string
+	}{
+		{"replace",
+			"# BEGIN RECORD 2.0-874\nnode.session.auth.authmethod = CHAP\nnode.session.auth.password = oldsecret\n# END RECORD\n",
+			"# BEGIN RECORD 2.0-874\nnode.session.auth.authmethod = CHAP\nnode.session.auth.password = averylongsecret\nnode.session.auth.password_in = peersecret12\n# END RECORD\n"},
+		{"add before end",
+			"# BEGIN RECORD 2.0-874\nnode.name = iqn.2005-10.org.freenas.ctl:docker-freenas001\n# END RECORD\n",
+			"# BEGIN RECORD 2.0-874\nnode.name = iqn.2005-10.org.freenas.ctl:docker-freenas001\nnode.session.auth.password = averylongsecret\nnode.session.auth.password_in = peersecret12\n# END RECORD\n"},
+		{"no end marker",
+			"node.name = iqn.2005-10.org.freenas.ctl:docker-freenas001\n",
+			"node.name = iqn.2005-10.org.freenas.ctl:docker-freenas001\nnode.session.auth.password = averylongsecret\nnode.session.auth.password_in = peersecret12\n"},
+	}
+	params := map[string]string{
+		"node.session.auth.password":    "averylongsecret",
+		"node.session.auth.password_in": "peersecret12",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := filepath.Join(dir, "default")
+			if err := ioutil.WriteFile(record, []byte(tt.record), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := updateNodeRecord(record, params); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("record is\n%s\nwant\n%s", got, tt.want)
+			}
+			fi, err := os.Stat(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0600 {
+				t.Errorf("record mode is %o, want 600", fi.Mode().Perm())
+			}
+		})
+	}
+}
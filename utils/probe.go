@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// BlkDevInfo is what ProbeBlkDev finds on a block device. Type uses the
+// blkid names: xfs, ext2, ext3, ext4, btrfs, crypto_LUKS and swap for
+// signatures, gpt and dos for partition tables.
+type BlkDevInfo struct {
+	Type string
+	UUID string
+}
+
+// probeSize covers the btrfs superblock at 64KiB.
+const probeSize = 64*1024 + 4096
+
+const (
+	extSuperblock = 1024
+	extMagic      = 0xEF53
+	// s_feature_compat
+	extHasJournal = 0x4
+	// s_feature_incompat bits only ext4 uses: extents, 64bit, flex_bg
+	extIncompatExt4 = 0x40 | 0x80 | 0x200
+	// s_feature_ro_compat bits only ext4 uses: huge_file, gdt_csum,
+	// dir_nlink, extra_isize, metadata_csum
+	extROCompatExt4 = 0x8 | 0x10 | 0x20 | 0x40 | 0x400
+
+	btrfsSuperblock = 64 * 1024
+)
+
+// ProbeBlkDev reads the superblock area of the device and reports the
+// filesystem, LUKS, swap or partition table signature on it. Type is ""
+// when none of them is found.
+func ProbeBlkDev(devpath string) (info BlkDevInfo, err error) {
+	f, err := os.Open(devpath)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+	buf := make([]byte, probeSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return info, fmt.Errorf("probe %s: %s", devpath, err)
+	}
+	return probe(buf[:n]), nil
+}
+
+func probe(b []byte) BlkDevInfo {
+	has := func(off int, magic string) bool {
+		return len(b) >= off+len(magic) && string(b[off:off+len(magic)]) == magic
+	}
+	switch {
+	case has(0, "LUKS\xba\xbe") && len(b) >= 208:
+		// LUKS1 and LUKS2 keep the UUID as a string at offset 168
+		return BlkDevInfo{Type: "crypto_LUKS", UUID: cString(b[168:208])}
+	case has(0, "XFSB") && len(b) >= 48:
+		return BlkDevInfo{Type: "xfs", UUID: formatUUID(b[32:48])}
+	case len(b) >= extSuperblock+0x78 && binary.LittleEndian.Uint16(b[extSuperblock+0x38:]) == extMagic:
+		sb := b[extSuperblock:]
+		compat := binary.LittleEndian.Uint32(sb[0x5C:])
+		incompat := binary.LittleEndian.Uint32(sb[0x60:])
+		roCompat := binary.LittleEndian.Uint32(sb[0x64:])
+		typ := "ext2"
+		if incompat&extIncompatExt4 != 0 || roCompat&extROCompatExt4 != 0 {
+			typ = "ext4"
+		} else if compat&extHasJournal != 0 {
+			typ = "ext3"
+		}
+		return BlkDevInfo{Type: typ, UUID: formatUUID(sb[0x68:0x78])}
+	case has(btrfsSuperblock+0x40, "_BHRfS_M"):
+		return BlkDevInfo{Type: "btrfs", UUID: formatUUID(b[btrfsSuperblock+0x20 : btrfsSuperblock+0x30])}
+	case has(4096-10, "SWAPSPACE2"), has(4096-10, "SWAP-SPACE"):
+		// the swap header follows the 1KiB boot block:
+		// version, last_page, nr_badpages, uuid
+		return BlkDevInfo{Type: "swap", UUID: formatUUID(b[1024+12 : 1024+28])}
+	case has(512, "EFI PART"):
+		return BlkDevInfo{Type: "gpt"}
+	case len(b) >= 512 && b[510] == 0x55 && b[511] == 0xAA && hasMBRPartition(b):
+		return BlkDevInfo{Type: "dos"}
+	}
+	return BlkDevInfo{}
+}
+
+// hasMBRPartition reports whether one of the four MBR partition entries
+// has a partition type, so a boot sector alone is not taken for a table.
+func hasMBRPartition(b []byte) bool {
+	for i := 0; i < 4; i++ {
+		if b[446+16*i+4] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func formatUUID(u []byte) string {
+	if bytes.Count(u, []byte{0}) == len(u) {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+var probeUUID = []byte{
+	0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0,
+	0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef,
+}
+
+const probeUUIDString = "12345678-9abc-def0-0123-456789abcdef"
+
+func xfsSuperblock() []byte {
+	b := make([]byte, probeSize)
+	copy(b, "XFSB")
+	copy(b[32:], probeUUID)
+	return b
+}
+
+func extSuperblockBuf(compat, incompat, roCompat uint32) []byte {
+	b := make([]byte, probeSize)
+	sb := b[extSuperblock:]
+	binary.LittleEndian.PutUint16(sb[0x38:], extMagic)
+	binary.LittleEndian.PutUint32(sb[0x5C:], compat)
+	binary.LittleEndian.PutUint32(sb[0x60:], incompat)
+	binary.LittleEndian.PutUint32(sb[0x64:], roCompat)
+	copy(sb[0x68:], probeUUID)
+	return b
+}
+
+func btrfsSuperblockBuf() []byte {
+	b := make([]byte, probeSize)
+	copy(b[btrfsSuperblock+0x20:], probeUUID)
+	copy(b[btrfsSuperblock+0x40:], "_BHRfS_M")
+	return b
+}
+
+func luksHeader() []byte {
+	b := make([]byte, probeSize)
+	copy(b, "LUKS\xba\xbe")
+	copy(b[168:], probeUUIDString)
+	return b
+}
+
+func swapHeader(magic string) []byte {
+	b := make([]byte, probeSize)
+	copy(b[1024+12:], probeUUID)
+	copy(b[4096-10:], magic)
+	return b
+}
+
+func gptHeader() []byte {
+	b := make([]byte, probeSize)
+	// protective MBR in front of the GPT header
+	b[446+4] = 0xEE
+	b[510], b[511] = 0x55, 0xAA
+	copy(b[512:], "EFI PART")
+	return b
+}
+
+func mbr(partitionType byte) []byte {
+	b := make([]byte, probeSize)
+	b[446+16+4] = partitionType
+	b[510], b[511] = 0x55, 0xAA
+	return b
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		want BlkDevInfo
+	}{
+		{"blank", make([]byte, probeSize), BlkDevInfo{}},
+		{"short read", []byte("XFS"), BlkDevInfo{}},
+		{"xfs", xfsSuperblock(), BlkDevInfo{Type: "xfs", UUID: probeUUIDString}},
+		{"ext2", extSuperblockBuf(0, 0, 0), BlkDevInfo{Type: "ext2", UUID: probeUUIDString}},
+		{"ext3", extSuperblockBuf(extHasJournal, 0, 0), BlkDevInfo{Type: "ext3", UUID: probeUUIDString}},
+		{"ext4 extents", extSuperblockBuf(extHasJournal, 0x40, 0), BlkDevInfo{Type: "ext4", UUID: probeUUIDString}},
+		{"ext4 metadata_csum", extSuperblockBuf(extHasJournal, 0, 0x400), BlkDevInfo{Type: "ext4", UUID: probeUUIDString}},
+		{"btrfs", btrfsSuperblockBuf(), BlkDevInfo{Type: "btrfs", UUID: probeUUIDString}},
+		{"luks", luksHeader(), BlkDevInfo{Type: "crypto_LUKS", UUID: probeUUIDString}},
+		{"swap", swapHeader("SWAPSPACE2"), BlkDevInfo{Type: "swap", UUID: probeUUIDString}},
+		{"old swap", swapHeader("SWAP-SPACE"), BlkDevInfo{Type: "swap", UUID: probeUUIDString}},
+		{"gpt", gptHeader(), BlkDevInfo{Type: "gpt"}},
+		{"mbr", mbr(0x83), BlkDevInfo{Type: "dos"}},
+		{"boot sector without partitions", mbr(0), BlkDevInfo{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := probe(tt.buf); got != tt.want {
+				t.Errorf("probe() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatUUIDZero(t *testing.T) {
+	if got := formatUUID(make([]byte, 16)); got != "" {
+		t.Errorf("formatUUID(zero) = %q, want \"\"", got)
+	}
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// SCSI-3 persistent reservations are managed with sg_persist from sg3-utils.
+// Write Exclusive lets only the I_T nexus holding the reservation write, so
+// it fits a single path. With multipath every path of the holder registers
+// the same key, and Write Exclusive - Registrants Only lets all of them
+// write while other hosts can still only read.
+const (
+	PRTypeWriteExclusive                = "1"
+	PRTypeWriteExclusiveRegistrantsOnly = "5"
+)
+
+func sgPersist(args ...string) (string, error) {
+	out, err := exec.Command("sg_persist", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("sg_persist %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// RegisterPRKey registers key as this host's reservation key on the device,
+// replacing any key registered before.
+func RegisterPRKey(diskpath, key string) error {
+	_, err := sgPersist("--out", "--register-ignore", "--param-sark="+key, diskpath)
+	return err
+}
+
+// UnregisterPRKey removes the registration of key from the device.
+func UnregisterPRKey(diskpath, key string) error {
+	_, err := sgPersist("--out", "--register", "--param-rk="+key, "--param-sark=0", diskpath)
+	return err
+}
+
+// ReservePR takes a reservation of prType with a registered key.
+func ReservePR(diskpath, key, prType string) error {
+	_, err := sgPersist("--out", "--reserve", "--param-rk="+key, "--prout-type="+prType, diskpath)
+	return err
+}
+
+func ReleasePR(diskpath, key, prType string) error {
+	_, err := sgPersist("--out", "--release", "--param-rk="+key, "--prout-type="+prType, diskpath)
+	return err
+}
+
+// PreemptPR takes the reservation over from the holder key and removes its
+// registration, aborting the holder's outstanding commands, so a host
+// that lost the volume can no longer write to it.
+func PreemptPR(diskpath, key, holder, prType string) error {
+	_, err := sgPersist("--out", "--preempt-abort", "--param-rk="+key, "--param-sark="+holder, "--prout-type="+prType, diskpath)
+	return err
+}
+
+var prKeyRegexp = regexp.MustCompile(`Key=(0x[0-9a-fA-F]+)`)
+
+// GetPRHolder returns the key of the current reservation holder, or "" when
+// the device is not reserved.
+func GetPRHolder(diskpath string) (key string, err error) {
+	out, err := sgPersist("--in", "--read-reservation", diskpath)
+	if err != nil {
+		return "", err
+	}
+	m := prKeyRegexp.FindStringSubmatch(out)
+	if len(m) == 0 {
+		return "", nil
+	}
+	return m[1], nil
+}
@@ -4,72 +4,246 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
 	"os/exec"
-	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
-func FindISCSIIQN(hostname, targetname string) (iqn string, err error) {
-	out, err := exec.Command("iscsiadm", "-m", "discovery", "-t", "st", "-p", hostname).Output()
+func LoginISCSITarget(iqn string) error {
+	out, err := exec.Command("iscsiadm", "-m", "node", "--targetname="+iqn, "--login").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iscsiadm login %s: %s: %s", iqn, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func LogoutISCSITarget(iqn string) error {
+	cmd := fmt.Sprintf("iscsiadm -m node --targetname=%s --logout", iqn)
+	return exec.Command("sh", "-c", cmd).Run()
+}
+
+// GetBlkDevType returns the filesystem type on the device, "" when it has
+// none or cannot be read.
+func GetBlkDevType(devpath string) (blktype string) {
+	info, _ := ProbeBlkDev(devpath)
+	return info.Type
+}
+
+// FormatXFS creates an XFS filesystem on diskpath. force overwrites an
+// existing signature.
+func FormatXFS(diskpath string, force bool) error {
+	opts := ""
+	if force {
+		opts = "-f "
+	}
+	cmd := exec.Command("sh", "-c", fmt.Sprintf("mkfs.xfs %s%s", opts, diskpath))
+	_, err := cmd.CombinedOutput()
+	return err
+}
+
+// RegenerateXFSUUID gives the XFS filesystem on diskpath a new UUID, so a
+// clone can be mounted on the same host as its origin. xfs_admin refuses a
+// dirty log, which is replayed first by mounting with nouuid.
+func RegenerateXFSUUID(diskpath string) error {
+	if exec.Command("xfs_admin", "-U", "generate", diskpath).Run() == nil {
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "xfs-replay")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+	if err := Mount(diskpath, dir, "xfs", false, "nouuid"); err != nil {
+		return err
+	}
+	if err := Unmount(dir); err != nil {
+		return err
+	}
+	out, err := exec.Command("xfs_admin", "-U", "generate", diskpath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("xfs_admin: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func RescanISCSISession() error {
+	return exec.Command("iscsiadm", "-m", "session", "--rescan").Run()
+}
+
+func GetBlkDevSize(devpath string) (size int64, err error) {
+	out, err := exec.Command("blockdev", "--getsize64", devpath).Output()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// GrowFS extends the filesystem on diskpath, mounted at mountpoint, to the
+// size of the underlying block device.
+func GrowFS(diskpath, mountpoint string) error {
+	var cmd *exec.Cmd
+	switch fstype := GetBlkDevType(diskpath); fstype {
+	case "xfs":
+		cmd = exec.Command("xfs_growfs", mountpoint)
+	case "ext2", "ext3", "ext4":
+		cmd = exec.Command("resize2fs", diskpath)
+	default:
+		return fmt.Errorf("unable to grow filesystem type %q on %s", fstype, diskpath)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// FreezeFS suspends writes to the filesystem mounted at mountpoint and
+// flushes it to disk, so a snapshot of the device is consistent.
+func FreezeFS(mountpoint string) error {
+	out, err := exec.Command("fsfreeze", "-f", mountpoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func ThawFS(mountpoint string) error {
+	out, err := exec.Command("fsfreeze", "-u", mountpoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// GetInitiatorName returns the iSCSI initiator IQN of this host.
+func GetInitiatorName() (iqn string, err error) {
+	f, err := os.Open("/etc/iscsi/initiatorname.iscsi")
 	if err != nil {
 		return "", err
 	}
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasSuffix(line, ":"+targetname) {
-			iqn = strings.Split(line, " ")[1]
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "InitiatorName=") {
+			return strings.TrimPrefix(line, "InitiatorName="), nil
 		}
 	}
-	if iqn == "" {
-		return "", errors.New("IQN not found")
+	if err := scanner.Err(); err != nil {
+		return "", err
 	}
-	return iqn, nil
+	return "", errors.New("InitiatorName not found")
 }
 
-func LoginISCSITarget(iqn string) error {
-	cmd := fmt.Sprintf("iscsiadm -m node --targetname=%s --login", iqn)
-	return exec.Command("sh", "-c", cmd).Run()
-}
-
-func LogoutISCSITarget(iqn string) error {
-	cmd := fmt.Sprintf("iscsiadm -m node --targetname=%s --logout", iqn)
-	return exec.Command("sh", "-c", cmd).Run()
+// UpdateISCSINode sets a parameter of the node record of the target, e.g.
+// node.session.auth.username, which is used by the next login.
+func UpdateISCSINode(iqn, name, value string) error {
+	out, err := exec.Command("iscsiadm", "-m", "node", "-T", iqn, "-o", "update", "-n", name, "-v", value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iscsiadm update %s: %s: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
 }
 
-func GetISCSIDiskPath(hostname, targetname string) (diskpath string, err error) {
+// DiscoverISCSITarget runs sendtargets discovery through hostname and
+// returns the IQN of the target and the by-path device of LUN lun on every
+// portal reported for it.
+func DiscoverISCSITarget(hostname, targetname string, lun int) (iqn string, diskpaths []string, err error) {
 	out, err := exec.Command("iscsiadm", "-m", "discovery", "-t", "st", "-p", hostname).Output()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	scanner := bufio.NewScanner(strings.NewReader(string(out)))
-	var discovery string
 	for scanner.Scan() {
 		line := scanner.Text()
-		if strings.HasSuffix(line, ":"+targetname) {
-			discovery = line
+		if !strings.HasSuffix(line, ":"+targetname) {
+			continue
 		}
+		address := strings.Split(line, " ")[0]
+		iqn = strings.Split(line, " ")[1]
+		diskpaths = append(diskpaths, ISCSIDiskPath(strings.Split(address, ",")[0], iqn, lun))
 	}
-	if discovery == "" {
-		return "", errors.New("Target not found")
+	if iqn == "" {
+		return "", nil, errors.New("Target not found")
 	}
-	address, iqn := strings.Split(discovery, " ")[0], strings.Split(discovery, " ")[1]
-	diskpath = fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-0", strings.Split(address, ",")[0], iqn)
-	return diskpath, err
+	return iqn, diskpaths, nil
 }
 
-func GetBlkDevType(devpath string) (blktype string) {
-	out, _ := exec.Command("blkid", devpath).Output()
-	re := regexp.MustCompile(`TYPE="([^"]*)"`)
-	m := re.FindStringSubmatch(string(out))
-	if len(m) == 0 {
-		return ""
+// ISCSIPortal resolves a storage address to the ip:port form used for node
+// records, with the default iSCSI port when none is given.
+func ISCSIPortal(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = strings.Trim(address, "[]"), "3260"
+	}
+	if net.ParseIP(host) == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return "", err
+		}
+		host = ips[0].String()
 	}
-	return m[1]
+	return net.JoinHostPort(host, port), nil
 }
 
-func FormatXFS(diskpath string) error {
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("mkfs.xfs %s", diskpath))
-	_, err := cmd.CombinedOutput()
-	return err
+// ISCSIDiskPath is the by-path device of LUN lun of the target on portal.
+// udev names IPv6 portals without brackets.
+func ISCSIDiskPath(portal, iqn string, lun int) string {
+	if host, port, err := net.SplitHostPort(portal); err == nil {
+		portal = host + ":" + port
+	}
+	return fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-%d", portal, iqn, lun)
+}
+
+// CreateISCSINode creates the node record of the target on portal without
+// running discovery. An existing record is left as it is.
+func CreateISCSINode(iqn, portal string) error {
+	if exec.Command("iscsiadm", "-m", "node", "-T", iqn, "-p", portal).Run() == nil {
+		return nil
+	}
+	out, err := exec.Command("iscsiadm", "-m", "node", "-T", iqn, "-p", portal, "-o", "new").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iscsiadm new node %s: %s: %s", portal, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// CheckFS runs the checker for the filesystem type on diskpath. ext
+// filesystems are repaired with e2fsck -p, which only fixes what is safe
+// without a human; XFS is checked with xfs_repair -n, which never modifies
+// the device. repaired reports that e2fsck corrected errors, err that
+// problems remain.
+func CheckFS(diskpath, fstype string) (repaired bool, output string, err error) {
+	var cmd *exec.Cmd
+	switch fstype {
+	case "xfs":
+		cmd = exec.Command("xfs_repair", "-n", diskpath)
+	case "ext2", "ext3", "ext4":
+		cmd = exec.Command("e2fsck", "-p", diskpath)
+	default:
+		return false, "", fmt.Errorf("unable to check filesystem type %q on %s", fstype, diskpath)
+	}
+	out, err := cmd.CombinedOutput()
+	output = strings.TrimSpace(string(out))
+	if err == nil {
+		return false, output, nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false, output, err
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false, output, err
+	}
+	code := status.ExitStatus()
+	if fstype != "xfs" && code < 4 {
+		// 1: errors corrected, 2: corrected, reboot advised
+		return true, output, nil
+	}
+	return false, output, fmt.Errorf("%s exited with %d", cmd.Args[0], code)
 }
@@ -0,0 +1,46 @@
+package utils
+
+import "testing"
+
+func TestISCSIPortal(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"192.168.1.10", "192.168.1.10:3260"},
+		{"192.168.1.10:3261", "192.168.1.10:3261"},
+		{"fd00::10", "[fd00::10]:3260"},
+		{"[fd00::10]", "[fd00::10]:3260"},
+		{"[fd00::10]:3261", "[fd00::10]:3261"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			got, err := ISCSIPortal(tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ISCSIPortal(%q) = %q, want %q", tt.address, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestISCSIDiskPath(t *testing.T) {
+	const iqn = "iqn.2005-10.org.freenas.ctl:docker-freenas001"
+	tests := []struct {
+		portal string
+		lun    int
+		want   string
+	}{
+		{"192.168.1.10:3260", 0, "/dev/disk/by-path/ip-192.168.1.10:3260-iscsi-" + iqn + "-lun-0"},
+		{"[fd00::10]:3260", 3, "/dev/disk/by-path/ip-fd00::10:3260-iscsi-" + iqn + "-lun-3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.portal, func(t *testing.T) {
+			if got := ISCSIDiskPath(tt.portal, iqn, tt.lun); got != tt.want {
+				t.Errorf("ISCSIDiskPath(%q) = %q, want %q", tt.portal, got, tt.want)
+			}
+		})
+	}
+}
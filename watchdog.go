@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daneshih1125/docker-volume-freenas/utils"
+)
+
+const webhookTimeout = 10 * time.Second
+
+const (
+	sessionFailed    = "failed"
+	sessionRecovered = "recovered"
+)
+
+// sessionEvent is posted to the webhook when the sessions of a mounted
+// volume fail and could not be recovered, and when they recover.
+type sessionEvent struct {
+	Event  string    `json:"event"`
+	Volume string    `json:"volume"`
+	Host   string    `json:"host"`
+	Target string    `json:"target"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// sessionCheck is a mounted volume as the watchdog saw it, checked and
+// recovered without holding the driver lock.
+type sessionCheck struct {
+	name       string
+	v          *FreeNASISCSIVolume
+	iqn        string
+	paths      []string
+	attachment int
+	// problem is what is still wrong after the recovery, "" when the
+	// sessions are healthy; err is set when they could not be checked.
+	problem string
+	err     error
+}
+
+// runSessionWatchdog checks the iSCSI sessions of every volume mounted on
+// this host and tries to recover the broken ones. Logins and device waits
+// run without the driver lock, so a recovery does not hold up the other
+// volumes. It never returns.
+func (d *FreeNASISCSIDriver) runSessionWatchdog(interval time.Duration) {
+	for range time.Tick(interval) {
+		var checks []*sessionCheck
+		d.RLock()
+		for name, v := range d.volumes {
+			if v.connections == 0 || v.iqn == "" {
+				continue
+			}
+			checks = append(checks, &sessionCheck{name: name, v: v, iqn: v.iqn, paths: v.paths, attachment: v.attachment})
+		}
+		d.RUnlock()
+		for _, c := range checks {
+			d.checkSessions(c)
+		}
+		d.Lock()
+		for _, c := range checks {
+			// a volume unmounted meanwhile has nothing left to report
+			if c.v.attachment == c.attachment {
+				d.reportSessions(c)
+			}
+		}
+		d.Unlock()
+	}
+}
+
+// checkSessions checks the sessions of the volume and recovers them. It
+// holds sessionLock, so unmount cannot log out while sessions are logged
+// in again.
+func (d *FreeNASISCSIDriver) checkSessions(c *sessionCheck) {
+	d.sessionLock.Lock()
+	defer d.sessionLock.Unlock()
+	if c.v.attachment != c.attachment {
+		return
+	}
+	problem, err := d.sessionProblem(c)
+	if err != nil {
+		c.err = err
+		return
+	}
+	if problem != "" {
+		log.WithField("volume", c.name).Warnf("iSCSI sessions unhealthy, recovering: %s", problem)
+		if err := d.recoverSessions(c); err != nil {
+			log.WithField("volume", c.name).Errorf("iSCSI session recovery failed: %s", err)
+		}
+		problem, c.err = d.sessionProblem(c)
+	}
+	c.problem = problem
+}
+
+// reportSessions records the outcome of checkSessions on the volume and
+// logs and posts changes of state.
+func (d *FreeNASISCSIDriver) reportSessions(c *sessionCheck) {
+	v := c.v
+	if c.err != nil {
+		log.WithField("volume", c.name).Errorf("failed to check iSCSI sessions: %s", c.err)
+		return
+	}
+	v.paths = c.paths
+	if c.problem == v.sessionError {
+		return
+	}
+	event := sessionEvent{Volume: c.name, Target: c.iqn, Error: c.problem, Time: time.Now()}
+	switch {
+	case c.problem == "":
+		log.WithField("volume", c.name).Info("iSCSI sessions recovered")
+		event.Event = sessionRecovered
+	case v.sessionError == "":
+		log.WithField("volume", c.name).Errorf("iSCSI sessions failed: %s", c.problem)
+		event.Event = sessionFailed
+	default:
+		log.WithField("volume", c.name).Errorf("iSCSI sessions still failing: %s", c.problem)
+	}
+	if event.Event != "" {
+		d.notify(event)
+		v.sessionSince = event.Time
+	}
+	v.sessionError = c.problem
+}
+
+// sessionProblem describes what is wrong with the sessions and path devices
+// of the volume, "" when all of them are healthy.
+func (d *FreeNASISCSIDriver) sessionProblem(c *sessionCheck) (string, error) {
+	states, err := utils.ISCSISessionStates(c.iqn)
+	if err != nil {
+		return "", err
+	}
+	var problems []string
+	if len(states) < len(c.paths) {
+		problems = append(problems, fmt.Sprintf("%d of %d sessions logged in", len(states), len(c.paths)))
+	}
+	sessions := make([]string, 0, len(states))
+	for session := range states {
+		sessions = append(sessions, session)
+	}
+	sort.Strings(sessions)
+	for _, session := range sessions {
+		if states[session] != "LOGGED_IN" {
+			problems = append(problems, fmt.Sprintf("%s is %s", session, states[session]))
+		}
+	}
+	for _, p := range c.paths {
+		if state := utils.GetPathState(p); state != "running" {
+			problems = append(problems, fmt.Sprintf("%s is %s", p, state))
+		}
+	}
+	return strings.Join(problems, ", "), nil
+}
+
+// recoverSessions logs in again to the portals whose session is gone and
+// brings devices the kernel took offline back online. With multipath a
+// failed session is logged out first, so it is logged in again from
+// scratch; a single failed path is left to iscsid, which keeps reconnecting
+// it, since logging it out would remove the device the filesystem is
+// mounted on. A path that came back as a new device is picked up with
+// multipath; without it the filesystem stays on the lost device until the
+// volume is mounted again.
+func (d *FreeNASISCSIDriver) recoverSessions(c *sessionCheck) error {
+	states, err := utils.ISCSISessionStates(c.iqn)
+	if err != nil {
+		return err
+	}
+	if d.opts.Multipath {
+		for session, state := range states {
+			if state != "FAILED" {
+				continue
+			}
+			if err := utils.LogoutISCSISession(session); err != nil {
+				return err
+			}
+			delete(states, session)
+		}
+	}
+	if len(states) < len(c.paths) {
+		loginErr := utils.LoginISCSITarget(c.iqn)
+		devices, err := utils.WaitISCSIDevices(c.iqn, c.v.LunID, len(c.paths), d.opts.DeviceTimeout)
+		if err != nil {
+			if loginErr != nil {
+				return fmt.Errorf("login to %s failed: %s", c.iqn, loginErr)
+			}
+			return err
+		}
+		if loginErr != nil {
+			// iscsiadm also fails for the portals that still had a session
+			log.WithField("volume", c.name).Debugf("login to %s: %s", c.iqn, loginErr)
+		}
+		if d.opts.Multipath {
+			c.paths = devices
+		}
+	}
+	for _, p := range c.paths {
+		if utils.GetPathState(p) == "offline" {
+			if err := utils.SetPathRunning(p); err != nil {
+				return err
+			}
+		}
+	}
+	if d.opts.PersistentReservation && !c.v.ReadOnly {
+		// registrations are lost when FreeNAS restarts
+		return d.reserveDevice(c.v, c.paths, false)
+	}
+	return nil
+}
+
+// notify posts the event to FREENAS_WEBHOOK_URL without holding up the
+// watchdog.
+func (d *FreeNASISCSIDriver) notify(event sessionEvent) {
+	if d.opts.WebhookURL == "" {
+		return
+	}
+	event.Host, _ = os.Hostname()
+	go func() {
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Errorf("webhook: %s", err)
+			return
+		}
+		client := &http.Client{Timeout: webhookTimeout}
+		resp, err := client.Post(d.opts.WebhookURL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Errorf("webhook: %s", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Errorf("webhook: %s", resp.Status)
+		}
+	}()
+}
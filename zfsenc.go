@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/daneshih1125/docker-volume-freenas/freenas"
+)
+
+const (
+	zfsKeyPassphrase = "passphrase"
+	zfsKeyHex        = "key"
+)
+
+var zfsEncryptionAlgorithms = []string{
+	"AES-128-CCM", "AES-192-CCM", "AES-256-CCM",
+	"AES-128-GCM", "AES-192-GCM", "AES-256-GCM",
+}
+
+// parseZFSEncryption validates the zfs_encryption option and returns the
+// algorithm as TrueNAS names it.
+func parseZFSEncryption(val string) (string, error) {
+	alg := strings.ToUpper(val)
+	for _, a := range zfsEncryptionAlgorithms {
+		if a == alg {
+			return alg, nil
+		}
+	}
+	return "", fmt.Errorf("Invalid zfs_encryption value, use one of %s", strings.ToLower(strings.Join(zfsEncryptionAlgorithms, ", ")))
+}
+
+// createEncryptedDataset creates the zvol or dataset of v with ZFS native
+// encryption. With a passphrase, which is generated into the keyring, the
+// volume can be locked; with a key TrueNAS generates and keeps the key.
+func (d *FreeNASISCSIDriver) createEncryptedDataset(v *FreeNASISCSIVolume) error {
+	enc := freenas.ZFSEncryptionOptions{Algorithm: v.ZFSEncryption}
+	if v.ZFSKeyFormat == zfsKeyPassphrase {
+		passphrase, err := d.zfsKeys(v).key(v, true)
+		if err != nil {
+			return err
+		}
+		enc.Passphrase = string(passphrase)
+	} else {
+		enc.GenerateKey = true
+	}
+	return d.freenas.CreateEncryptedZFSDataset(v.PoolName, v.Name, v.isBlock(), v.Size, v.Reservation, enc)
+}
+
+// unlockDataset unlocks the volume's dataset if it is locked, before its
+// share is mounted or its target is logged in to.
+func (d *FreeNASISCSIDriver) unlockDataset(v *FreeNASISCSIVolume) error {
+	if v.ZFSEncryption == "" {
+		return nil
+	}
+	enc, err := d.freenas.GetZFSDatasetEncryption(v.dataset())
+	if err != nil {
+		return err
+	}
+	if !enc.Locked {
+		return nil
+	}
+	if v.ZFSKeyFormat != zfsKeyPassphrase {
+		return fmt.Errorf("volume %s is locked and its key is kept by TrueNAS, unlock it there", v.Name)
+	}
+	passphrase, err := d.zfsKeys(v).key(v, false)
+	if err != nil {
+		return err
+	}
+	log.WithField("volume", v.Name).Info("unlocking dataset")
+	return d.freenas.UnlockZFSDataset(v.dataset(), string(passphrase))
+}
+
+// lockDataset locks the volume's dataset so its data cannot be read until
+// it is unlocked again.
+func (d *FreeNASISCSIDriver) lockDataset(v *FreeNASISCSIVolume) error {
+	if v.ZFSEncryption == "" {
+		return fmt.Errorf("volume %s is not ZFS encrypted", v.Name)
+	}
+	if v.ZFSKeyFormat != zfsKeyPassphrase {
+		return fmt.Errorf("volume %s uses a key kept by TrueNAS, only passphrase encrypted volumes can be locked", v.Name)
+	}
+	log.WithField("volume", v.Name).Info("locking dataset")
+	return d.freenas.LockZFSDataset(v.dataset())
+}
+
+// lockRemovedDataset locks a passphrase encrypted dataset before it is
+// destroyed, so its data stays unreadable if destroying it fails.
+func (d *FreeNASISCSIDriver) lockRemovedDataset(v *FreeNASISCSIVolume) {
+	if v.ZFSKeyFormat != zfsKeyPassphrase {
+		return
+	}
+	if err := d.lockDataset(v); err != nil {
+		log.WithField("volume", v.Name).Errorf("failed to lock dataset: %s", err)
+	}
+}
+
+// LockVolume locks the dataset of a ZFS encrypted volume that is not in use
+// on any host.
+func (d *FreeNASISCSIDriver) LockVolume(name string) error {
+	log.WithField("method", "lock").Debug(name)
+
+	d.Lock()
+	defer d.Unlock()
+
+	v, err := d.findVolume(name)
+	if err != nil {
+		return err
+	}
+	attached, err := d.volumeAttached(v)
+	if err != nil {
+		return err
+	}
+	if attached {
+		return fmt.Errorf("volume %s is in use", name)
+	}
+	return d.lockDataset(v)
+}
+
+// UnlockVolume unlocks the dataset of a ZFS encrypted volume.
+func (d *FreeNASISCSIDriver) UnlockVolume(name string) error {
+	log.WithField("method", "unlock").Debug(name)
+
+	d.Lock()
+	defer d.Unlock()
+
+	v, err := d.findVolume(name)
+	if err != nil {
+		return err
+	}
+	if v.ZFSEncryption == "" {
+		return fmt.Errorf("volume %s is not ZFS encrypted", name)
+	}
+	return d.unlockDataset(v)
+}
+
+// ExportKey returns the key of a ZFS encrypted volume: the passphrase from
+// the keyring, or the key exported from TrueNAS.
+func (d *FreeNASISCSIDriver) ExportKey(name string) (string, error) {
+	log.WithField("method", "export key").Debug(name)
+
+	d.Lock()
+	defer d.Unlock()
+
+	v, err := d.findVolume(name)
+	if err != nil {
+		return "", err
+	}
+	if v.ZFSEncryption == "" {
+		return "", fmt.Errorf("volume %s is not ZFS encrypted", name)
+	}
+	if v.ZFSKeyFormat == zfsKeyPassphrase {
+		passphrase, err := d.zfsKeys(v).key(v, false)
+		return string(passphrase), err
+	}
+	return d.freenas.ExportZFSDatasetKey(v.dataset())
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestParseZFSEncryption(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    string
+		wantErr bool
+	}{
+		{"aes-256-gcm", "AES-256-GCM", false},
+		{"AES-128-CCM", "AES-128-CCM", false},
+		{"Aes-192-Gcm", "AES-192-GCM", false},
+		{"aes-256-cbc", "", true},
+		{"on", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.val, func(t *testing.T) {
+			got, err := parseZFSEncryption(tt.val)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseZFSEncryption(%q) error = %v, want error %v", tt.val, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseZFSEncryption(%q) = %q, want %q", tt.val, got, tt.want)
+			}
+		})
+	}
+}